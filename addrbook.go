@@ -0,0 +1,388 @@
+// Copyright 2019 cruzbit developers
+// Use of this source code is governed by a MIT-style license that can be found in the LICENSE file.
+
+package cruzbit
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// newBucketCount is the number of buckets used to hold addresses we've
+	// learned about but never successfully connected to.
+	newBucketCount = 64
+
+	// triedBucketCount is the number of buckets used to hold addresses we've
+	// previously completed a handshake with.
+	triedBucketCount = 32
+
+	// bucketSize caps how many addresses a single bucket can hold before we
+	// start evicting the worst entry to make room.
+	bucketSize = 64
+
+	// triedStaleAfter is how long it's been since a tried entry's last
+	// success before isTerrible considers it stale.
+	triedStaleAfter = 30 * 24 * time.Hour
+
+	// maxNewAttempts is how many failed connection attempts a new entry can
+	// accumulate before isTerrible gives up on it.
+	maxNewAttempts = 10
+)
+
+// addrBookEntry tracks what we know about a single peer address.
+type addrBookEntry struct {
+	Addr         string    `json:"addr"`
+	Source       string    `json:"source"`
+	LastAttempt  time.Time `json:"lastAttempt"`
+	LastSuccess  time.Time `json:"lastSuccess"`
+	AttemptCount int       `json:"attemptCount"`
+}
+
+// isTerrible reports whether an entry is bad enough that it's safe to evict
+// in favor of a new one, using bitcoin's heuristic: never having connected
+// after a handful of tries, or not having been seen in a long time.
+func (e *addrBookEntry) isTerrible(now time.Time) bool {
+	if now.Sub(e.LastAttempt) < 60*time.Second {
+		// we just tried it, give it a chance
+		return false
+	}
+	if e.LastSuccess.IsZero() && e.AttemptCount >= maxNewAttempts {
+		return true
+	}
+	if !e.LastSuccess.IsZero() && now.Sub(e.LastSuccess) > triedStaleAfter {
+		return true
+	}
+	return false
+}
+
+// AddrBook is a bitcoin-style address book: addresses we've merely heard
+// about live in "new" buckets, and addresses we've successfully handshaked
+// with graduate to "tried" buckets. Sampling for outbound connections leans
+// toward tried addresses the more outbound slots are already filled, and
+// stale entries are evicted to make room rather than
+// letting a bucket grow without bound. It implements PeerStorage so it can
+// be dropped in wherever a peer address store is expected.
+type AddrBook struct {
+	dataDir string
+	mu      sync.Mutex
+	new     [newBucketCount]map[string]*addrBookEntry
+	tried   [triedBucketCount]map[string]*addrBookEntry
+	rand    *lockedRand
+}
+
+// addrBookFile is the on-disk representation of an AddrBook.
+type addrBookFile struct {
+	New   []*addrBookEntry `json:"new"`
+	Tried []*addrBookEntry `json:"tried"`
+}
+
+// NewAddrBook returns a new AddrBook, loading any previously persisted
+// buckets from dataDir.
+func NewAddrBook(dataDir string) (*AddrBook, error) {
+	ab := &AddrBook{dataDir: dataDir, rand: newLockedRand()}
+	for i := range ab.new {
+		ab.new[i] = make(map[string]*addrBookEntry)
+	}
+	for i := range ab.tried {
+		ab.tried[i] = make(map[string]*addrBookEntry)
+	}
+	if err := ab.load(); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return ab, nil
+}
+
+// Store implements PeerStorage. It records addr as a newly learned address,
+// with an empty source, if we haven't seen it before.
+func (a *AddrBook) Store(addr string) error {
+	return a.StoreWithSource(addr, "")
+}
+
+// StoreWithSource is Store with an explicit source address, used to key the
+// bucket so a single misbehaving source can't flood one bucket with sybils.
+// source is the address of the peer that told us about addr, or "" if it
+// came from a seed with no peer behind it.
+func (a *AddrBook) StoreWithSource(addr, source string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.find(addr) != nil {
+		// already known
+		return nil
+	}
+
+	bucket := a.new[newBucketFor(addr, source)]
+	if len(bucket) >= bucketSize {
+		a.evictWorst(bucket)
+	}
+	bucket[addr] = &addrBookEntry{Addr: addr, Source: source}
+	return a.save()
+}
+
+// Get implements PeerStorage. It samples up to n addresses the way GetBiased
+// does with no outbound slots filled: from the new table first, falling back
+// to the tried table once new is exhausted.
+func (a *AddrBook) Get(n int) ([]string, error) {
+	return a.GetBiased(n, 0)
+}
+
+// GetBiased samples up to n addresses, biased toward tried addresses in
+// proportion to filledOutbound (how many outbound slots we already have
+// filled) out of MAX_OUTBOUND_PEER_CONNECTIONS, capped at 90%, the way
+// bitcoind leans harder on known-good peers the closer we are to full.
+func (a *AddrBook) GetBiased(n, filledOutbound int) ([]string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	triedChance := filledOutbound * 100 / MAX_OUTBOUND_PEER_CONNECTIONS
+	if triedChance > 90 {
+		triedChance = 90
+	}
+
+	var addrs []string
+	seen := make(map[string]bool)
+	for len(addrs) < n {
+		var entry *addrBookEntry
+		if a.rand.Intn(100) < triedChance {
+			entry = a.sampleUnseen(a.tried[:], seen)
+			if entry == nil {
+				entry = a.sampleUnseen(a.new[:], seen)
+			}
+		} else {
+			entry = a.sampleUnseen(a.new[:], seen)
+			if entry == nil {
+				entry = a.sampleUnseen(a.tried[:], seen)
+			}
+		}
+		if entry == nil {
+			// no unseen candidate left in either table; further looping
+			// would just spin, so stop with whatever we have
+			break
+		}
+		seen[entry.Addr] = true
+		addrs = append(addrs, entry.Addr)
+	}
+	return addrs, nil
+}
+
+// MarkAttempt records an outbound connection attempt to addr.
+func (a *AddrBook) MarkAttempt(addr string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if e := a.find(addr); e != nil {
+		e.LastAttempt = time.Now()
+		e.AttemptCount++
+	}
+}
+
+// MarkGood moves addr from the new table into the tried table, recording a
+// successful handshake.
+func (a *AddrBook) MarkGood(addr string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var entry *addrBookEntry
+	for i, bucket := range a.new {
+		if e, ok := bucket[addr]; ok {
+			entry = e
+			delete(a.new[i], addr)
+			break
+		}
+	}
+	if entry == nil {
+		entry = a.find(addr)
+	}
+	if entry == nil {
+		entry = &addrBookEntry{Addr: addr}
+	}
+	entry.LastSuccess = time.Now()
+	entry.LastAttempt = entry.LastSuccess
+	entry.AttemptCount = 0
+
+	bucket := a.tried[triedBucketFor(addr)]
+	if len(bucket) >= bucketSize {
+		a.evictWorst(bucket)
+	}
+	bucket[addr] = entry
+	a.save()
+}
+
+// Has reports whether addr is already known, in either table.
+func (a *AddrBook) Has(addr string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.find(addr) != nil
+}
+
+func (a *AddrBook) find(addr string) *addrBookEntry {
+	for _, bucket := range a.new {
+		if e, ok := bucket[addr]; ok {
+			return e
+		}
+	}
+	for _, bucket := range a.tried {
+		if e, ok := bucket[addr]; ok {
+			return e
+		}
+	}
+	return nil
+}
+
+// sampleUnseen picks a uniformly random entry out of whichever of the given
+// buckets are non-empty, excluding addresses already in seen. It returns nil
+// once every entry across buckets has been seen, rather than spinning
+// forever returning duplicates.
+func (a *AddrBook) sampleUnseen(buckets []map[string]*addrBookEntry, seen map[string]bool) *addrBookEntry {
+	var all []*addrBookEntry
+	for _, bucket := range buckets {
+		for _, e := range bucket {
+			if !seen[e.Addr] {
+				all = append(all, e)
+			}
+		}
+	}
+	if len(all) == 0 {
+		return nil
+	}
+	return all[a.rand.Intn(len(all))]
+}
+
+// evictWorst drops the most terrible-looking entry in bucket to make room
+// for a new one, or the oldest entry if nothing looks outright terrible.
+func (a *AddrBook) evictWorst(bucket map[string]*addrBookEntry) {
+	now := time.Now()
+	var worstAddr string
+	var worst *addrBookEntry
+	for addr, e := range bucket {
+		if worst == nil {
+			worst = e
+			worstAddr = addr
+			continue
+		}
+		terrible, worstTerrible := e.isTerrible(now), worst.isTerrible(now)
+		switch {
+		case terrible && !worstTerrible:
+			// a terrible entry always beats a non-terrible one, regardless
+			// of age
+		case !terrible && worstTerrible:
+			continue
+		case e.LastAttempt.Before(worst.LastAttempt):
+			// neither or both are terrible, so age breaks the tie
+		default:
+			continue
+		}
+		worst = e
+		worstAddr = addr
+	}
+	if worst != nil {
+		delete(bucket, worstAddr)
+	}
+}
+
+func (a *AddrBook) save() error {
+	if len(a.dataDir) == 0 {
+		return nil
+	}
+	var f addrBookFile
+	for _, bucket := range a.new {
+		for _, e := range bucket {
+			f.New = append(f.New, e)
+		}
+	}
+	for _, bucket := range a.tried {
+		for _, e := range bucket {
+			f.Tried = append(f.Tried, e)
+		}
+	}
+	b, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(a.dataDir, "addrbook.json"), b, 0644)
+}
+
+func (a *AddrBook) load() error {
+	if len(a.dataDir) == 0 {
+		return nil
+	}
+	b, err := ioutil.ReadFile(filepath.Join(a.dataDir, "addrbook.json"))
+	if err != nil {
+		return err
+	}
+	var f addrBookFile
+	if err := json.Unmarshal(b, &f); err != nil {
+		return err
+	}
+	for _, e := range f.New {
+		a.new[newBucketFor(e.Addr, e.Source)][e.Addr] = e
+	}
+	for _, e := range f.Tried {
+		a.tried[triedBucketFor(e.Addr)][e.Addr] = e
+	}
+	return nil
+}
+
+// newBucketFor returns the new-table bucket index for addr, keyed by a hash
+// of its source and address groups so one source can't flood a bucket.
+func newBucketFor(addr, source string) int {
+	return int(groupHash(addrGroup(source), addrGroup(addr)) % newBucketCount)
+}
+
+// triedBucketFor returns the tried-table bucket index for addr, keyed only
+// by its own address group.
+func triedBucketFor(addr string) int {
+	return int(groupHash(addrGroup(addr), "") % triedBucketCount)
+}
+
+func groupHash(a, b string) uint64 {
+	sum := sha256.Sum256([]byte(a + "|" + b))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+// lockedRand is a mutex-guarded *rand.Rand, since AddrBook's sampling is
+// called from whichever goroutine is trying to connect out.
+type lockedRand struct {
+	mu  sync.Mutex
+	rnd *rand.Rand
+}
+
+func newLockedRand() *lockedRand {
+	return &lockedRand{rnd: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+func (l *lockedRand) Intn(n int) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rnd.Intn(n)
+}
+
+// addrGroup reduces an address to the network group it belongs to (its /16
+// for IPv4, /32 for IPv6, or itself for non-IP addresses like onion hosts),
+// which is what buckets are actually keyed on rather than the raw address.
+// addr may be scheme-tagged (see taggedAddr); the tag plays no part in the
+// grouping.
+func addrGroup(addr string) string {
+	_, addr = untagAddr(addr)
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return host
+	}
+	if v4 := ip.To4(); v4 != nil {
+		return fmt.Sprintf("%d.%d", v4[0], v4[1])
+	}
+	return ip.Mask(net.CIDRMask(32, 128)).String()
+}
@@ -0,0 +1,149 @@
+// Copyright 2019 cruzbit developers
+// Use of this source code is governed by a MIT-style license that can be found in the LICENSE file.
+
+package cruzbit
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// TestAddrBookGetBiasedStopsWhenExhausted guards against GetBiased spinning
+// forever when n exceeds the number of distinct addresses known: with only a
+// handful of addresses stored, it must return
+// promptly with at most that many results.
+func TestAddrBookGetBiasedStopsWhenExhausted(t *testing.T) {
+	ab, err := NewAddrBook("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := ab.Store(fmt.Sprintf("10.0.0.%d:8888", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	done := make(chan []string, 1)
+	go func() {
+		addrs, err := ab.GetBiased(10, 0)
+		if err != nil {
+			t.Error(err)
+		}
+		done <- addrs
+	}()
+
+	select {
+	case addrs := <-done:
+		if len(addrs) > 3 {
+			t.Fatalf("got %d addresses, only 3 are known", len(addrs))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("GetBiased did not return; likely spinning")
+	}
+}
+
+// TestAddrBookGetBiasedNoDuplicates guards against sampleUnseen handing back
+// an address already returned earlier in the same call.
+func TestAddrBookGetBiasedNoDuplicates(t *testing.T) {
+	ab, err := NewAddrBook("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		if err := ab.Store(fmt.Sprintf("10.0.%d.1:8888", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	addrs, err := ab.GetBiased(20, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 20 {
+		t.Fatalf("expected all 20 known addresses back, got %d", len(addrs))
+	}
+	seen := make(map[string]bool)
+	for _, addr := range addrs {
+		if seen[addr] {
+			t.Fatalf("address %s returned more than once", addr)
+		}
+		seen[addr] = true
+	}
+}
+
+func TestEvictWorstPrefersTerribleEntry(t *testing.T) {
+	now := time.Now()
+	bucket := map[string]*addrBookEntry{
+		"good:8888": {
+			Addr:        "good:8888",
+			LastAttempt: now,
+			LastSuccess: now,
+		},
+		"terrible:8888": {
+			Addr:         "terrible:8888",
+			LastAttempt:  now.Add(-time.Hour),
+			AttemptCount: maxNewAttempts,
+		},
+	}
+
+	(&AddrBook{}).evictWorst(bucket)
+
+	if _, ok := bucket["terrible:8888"]; ok {
+		t.Fatal("expected the terrible entry to be evicted")
+	}
+	if _, ok := bucket["good:8888"]; !ok {
+		t.Fatal("expected the good entry to survive")
+	}
+}
+
+// TestEvictWorstPrefersTerribleEntryOverOlderGoodOne confirms a terrible
+// entry is evicted even when a non-terrible entry has an older LastAttempt,
+// i.e. terribleness always wins over age rather than being OR'd with it.
+func TestEvictWorstPrefersTerribleEntryOverOlderGoodOne(t *testing.T) {
+	now := time.Now()
+	bucket := map[string]*addrBookEntry{
+		"terrible:8888": {
+			Addr:         "terrible:8888",
+			LastAttempt:  now.Add(-2 * time.Hour),
+			AttemptCount: maxNewAttempts * 2,
+		},
+		"good:8888": {
+			Addr:        "good:8888",
+			LastAttempt: now.Add(-3 * time.Hour),
+			LastSuccess: now,
+		},
+	}
+
+	(&AddrBook{}).evictWorst(bucket)
+
+	if _, ok := bucket["terrible:8888"]; ok {
+		t.Fatal("expected the terrible entry to be evicted despite being newer")
+	}
+	if _, ok := bucket["good:8888"]; !ok {
+		t.Fatal("expected the good entry to survive despite being older")
+	}
+}
+
+func TestEvictWorstPrefersOldestAttemptWhenNoneTerrible(t *testing.T) {
+	now := time.Now()
+	bucket := map[string]*addrBookEntry{
+		"newer:8888": {
+			Addr:        "newer:8888",
+			LastAttempt: now,
+		},
+		"older:8888": {
+			Addr:        "older:8888",
+			LastAttempt: now.Add(-time.Minute),
+		},
+	}
+
+	(&AddrBook{}).evictWorst(bucket)
+
+	if _, ok := bucket["older:8888"]; ok {
+		t.Fatal("expected the older entry to be evicted")
+	}
+	if _, ok := bucket["newer:8888"]; !ok {
+		t.Fatal("expected the newer entry to survive")
+	}
+}
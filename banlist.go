@@ -0,0 +1,170 @@
+// Copyright 2019 cruzbit developers
+// Use of this source code is governed by a MIT-style license that can be found in the LICENSE file.
+
+package cruzbit
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// defaultBanDuration is how long a peer stays banned after misbehaving
+// (bad handshake, invalid block, protocol violation) unless a caller asks
+// for something else.
+const defaultBanDuration = 24 * time.Hour
+
+// Banlist tracks peers that are temporarily forbidden from connecting to us
+// or being connected to. Most peers are keyed by IP so they can't just
+// reconnect from a different port; peers with a persistent transport identity
+// (e.g. NoiseTransport's static key) are also keyed on that identity, since
+// it survives them reconnecting from a new IP entirely. Bans are persisted to
+// disk so they survive a restart.
+type Banlist struct {
+	dataDir string
+	mu      sync.Mutex
+	bans    map[string]time.Time // ip or identityKey(identity) -> ban expiry
+}
+
+type banlistEntry struct {
+	Key     string    `json:"key"`
+	Expires time.Time `json:"expires"`
+}
+
+// identityKey namespaces an identity pubkey within bans so it can't collide
+// with an IP string.
+func identityKey(identity string) string {
+	return "identity:" + identity
+}
+
+// NewBanlist returns a new Banlist, loading any previously persisted bans
+// from dataDir.
+func NewBanlist(dataDir string) (*Banlist, error) {
+	b := &Banlist{dataDir: dataDir, bans: make(map[string]time.Time)}
+	if err := b.load(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Ban forbids addr's IP from connecting for the given duration. A loopback
+// IP is never banned: it's always the local endpoint of a proxied transport
+// (e.g. the socket Tor forwards hidden-service traffic to), never an actual
+// remote peer, so banning it would collide every peer behind that proxy
+// together. Ban the peer's identity instead for those transports.
+func (b *Banlist) Ban(addr string, reason string, duration time.Duration) error {
+	ip := banIP(addr)
+	if len(ip) == 0 || isLoopbackIP(ip) {
+		return nil
+	}
+	return b.ban(ip, reason, duration)
+}
+
+// BanIdentity forbids a peer authenticated under identity (e.g. a Noise
+// static pubkey) from connecting for the given duration, regardless of
+// address.
+func (b *Banlist) BanIdentity(identity string, reason string, duration time.Duration) error {
+	if len(identity) == 0 {
+		return nil
+	}
+	return b.ban(identityKey(identity), reason, duration)
+}
+
+// IsBanned reports whether addr's IP is currently banned. Like Ban, it never
+// reports a loopback IP as banned.
+func (b *Banlist) IsBanned(addr string) bool {
+	ip := banIP(addr)
+	if len(ip) == 0 || isLoopbackIP(ip) {
+		return false
+	}
+	return b.isBanned(ip)
+}
+
+// IsIdentityBanned reports whether identity is currently banned.
+func (b *Banlist) IsIdentityBanned(identity string) bool {
+	if len(identity) == 0 {
+		return false
+	}
+	return b.isBanned(identityKey(identity))
+}
+
+func (b *Banlist) ban(key string, reason string, duration time.Duration) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	log.Printf("Banning %s for %s: %s\n", key, duration, reason)
+	b.bans[key] = time.Now().Add(duration)
+	return b.save()
+}
+
+func (b *Banlist) isBanned(key string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	expires, ok := b.bans[key]
+	if !ok {
+		return false
+	}
+	if time.Now().After(expires) {
+		delete(b.bans, key)
+		return false
+	}
+	return true
+}
+
+func (b *Banlist) save() error {
+	if len(b.dataDir) == 0 {
+		return nil
+	}
+	var entries []banlistEntry
+	for key, expires := range b.bans {
+		entries = append(entries, banlistEntry{Key: key, Expires: expires})
+	}
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(b.dataDir, "banlist.json"), data, 0644)
+}
+
+func (b *Banlist) load() error {
+	if len(b.dataDir) == 0 {
+		return nil
+	}
+	data, err := ioutil.ReadFile(filepath.Join(b.dataDir, "banlist.json"))
+	if err != nil {
+		return nil
+	}
+	var entries []banlistEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, e := range entries {
+		if now.Before(e.Expires) {
+			b.bans[e.Key] = e.Expires
+		}
+	}
+	return nil
+}
+
+// banIP extracts the bannable IP portion of a peer address, stripping the
+// port since a banned peer is banned regardless of which port it connects
+// from, and any scheme tag (see taggedAddr) since it plays no part in a
+// peer's IP.
+func banIP(addr string) string {
+	_, addr = untagAddr(addr)
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	return host
+}
+
+// isLoopbackIP reports whether ip is a loopback address.
+func isLoopbackIP(ip string) bool {
+	parsed := net.ParseIP(ip)
+	return parsed != nil && parsed.IsLoopback()
+}
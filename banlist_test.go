@@ -0,0 +1,106 @@
+// Copyright 2019 cruzbit developers
+// Use of this source code is governed by a MIT-style license that can be found in the LICENSE file.
+
+package cruzbit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBanlistBanAndIsBanned(t *testing.T) {
+	bl, err := NewBanlist("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := "203.0.113.1:8888"
+	if bl.IsBanned(addr) {
+		t.Fatal("address should not be banned yet")
+	}
+	if err := bl.Ban(addr, "testing", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if !bl.IsBanned(addr) {
+		t.Fatal("address should be banned")
+	}
+}
+
+// TestBanlistBanIgnoresPort confirms a ban applies to the IP regardless of
+// which port the peer reconnects from.
+func TestBanlistBanIgnoresPort(t *testing.T) {
+	bl, err := NewBanlist("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bl.Ban("203.0.113.1:8888", "testing", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if !bl.IsBanned("203.0.113.1:1234") {
+		t.Fatal("expected ban to follow the IP to a different port")
+	}
+}
+
+// TestBanlistBanIdentityIgnoresAddress confirms an identity ban follows a
+// peer across addresses and doesn't collide with an IP-keyed ban.
+func TestBanlistBanIdentityIgnoresAddress(t *testing.T) {
+	bl, err := NewBanlist("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	identity := "deadbeef"
+	if bl.IsIdentityBanned(identity) {
+		t.Fatal("identity should not be banned yet")
+	}
+	if err := bl.BanIdentity(identity, "testing", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if !bl.IsIdentityBanned(identity) {
+		t.Fatal("identity should be banned")
+	}
+	if bl.IsBanned(identity) {
+		t.Fatal("identity ban shouldn't be visible as an IP ban")
+	}
+}
+
+// TestBanlistBanIgnoresLoopback confirms banning a loopback address (always
+// the local forwarding socket of a proxied transport like Tor, never an
+// actual remote peer) is a no-op, so one misbehaving peer behind the proxy
+// can't get every other peer behind it banned too.
+func TestBanlistBanIgnoresLoopback(t *testing.T) {
+	bl, err := NewBanlist("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := "127.0.0.1:40001"
+	if err := bl.Ban(addr, "testing", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if bl.IsBanned(addr) {
+		t.Fatal("loopback address should never be reported as banned")
+	}
+	if bl.IsBanned("127.0.0.1:40002") {
+		t.Fatal("a loopback ban must not apply to a different loopback port")
+	}
+}
+
+func TestBanlistExpiry(t *testing.T) {
+	bl, err := NewBanlist("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := "203.0.113.2:8888"
+	if err := bl.Ban(addr, "testing", time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if bl.IsBanned(addr) {
+		t.Fatal("expected ban to have expired")
+	}
+	if _, ok := bl.bans[banIP(addr)]; ok {
+		t.Fatal("expected IsBanned to prune the expired entry")
+	}
+}
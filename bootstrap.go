@@ -0,0 +1,214 @@
+// Copyright 2019 cruzbit developers
+// Use of this source code is governed by a MIT-style license that can be found in the LICENSE file.
+
+package cruzbit
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// DEFAULT_MIN_PEERS is how many outbound connections the peerBootstrapper
+// tries to maintain if the caller doesn't specify their own MinPeers.
+const DEFAULT_MIN_PEERS = 8
+
+const (
+	// bootstrapSampleMultiplier controls how many extra candidates we pull
+	// from our sources beyond the number of peers we're actually short of,
+	// since not every candidate will be reachable or worth dialing.
+	bootstrapSampleMultiplier = 3
+
+	// bootstrapWorkers bounds how many connection attempts a single
+	// bootstrap pass makes in parallel.
+	bootstrapWorkers = 8
+
+	// bootstrapInitialBackoff and bootstrapMaxBackoff bound the delay
+	// between bootstrap passes that fail to reach MinPeers, so an offline
+	// or seed-starved node doesn't hammer its sources.
+	bootstrapInitialBackoff = 2 * time.Second
+	bootstrapMaxBackoff     = 5 * time.Minute
+)
+
+// fallbackSeedAddrs are added to every bootstrap pass's candidates after DNS
+// seeds and every transport's own Bootstrap, so they're only stored when
+// those sources leave the pass short of fresh candidates. Operators can
+// replace this with their own list at build time.
+var fallbackSeedAddrs []string
+
+// bootstrap runs peerBootstrapper in its own goroutine. It's started once
+// from run() and keeps nudging us toward MinPeers outbound connections for
+// the lifetime of the PeerManager, rather than seeding once at startup.
+func (p *PeerManager) bootstrap() {
+	p.wg.Add(1)
+	go p.peerBootstrapper()
+}
+
+// peerBootstrapper is the main loop of the bootstrapper. It wakes up
+// whenever outboundPeerCount() might have fallen below MinPeers (on startup,
+// on a prod from wantMorePeers, or after its own backoff timer) and tries to
+// close the gap by querying every configured bootstrap source.
+func (p *PeerManager) peerBootstrapper() {
+	defer p.wg.Done()
+
+	backoff := bootstrapInitialBackoff
+	for {
+		if p.outboundPeerCount() < p.minPeers {
+			if p.bootstrapPass() {
+				backoff = bootstrapInitialBackoff
+			} else {
+				backoff *= 2
+				if backoff > bootstrapMaxBackoff {
+					backoff = bootstrapMaxBackoff
+				}
+				log.Printf("Bootstrap pass short of MinPeers, backing off %s\n", backoff)
+			}
+		} else {
+			backoff = bootstrapInitialBackoff
+		}
+
+		select {
+		case <-p.wantMorePeers:
+		case <-time.After(backoff):
+		case _, ok := <-p.shutdownChan:
+			if !ok {
+				return
+			}
+		}
+	}
+}
+
+// bootstrapPass queries every bootstrap source for candidates, dedups them
+// against the address book, and attempts connections to as many as we need
+// in parallel. It returns true if we reached MinPeers by the end of the
+// pass.
+func (p *PeerManager) bootstrapPass() bool {
+	needed := p.minPeers - p.outboundPeerCount()
+	if needed <= 0 {
+		return true
+	}
+	want := needed * bootstrapSampleMultiplier
+
+	p.ensureIRC()
+
+	var candidates []string
+	seen := make(map[string]bool)
+	add := func(addrs []string) {
+		for _, addr := range addrs {
+			if !seen[addr] {
+				seen[addr] = true
+				candidates = append(candidates, addr)
+			}
+		}
+	}
+
+	if addrs, err := dnsQueryForPeers(); err != nil {
+		log.Printf("Error from DNS query: %s\n", err)
+	} else {
+		add(addrs)
+	}
+
+	for _, t := range p.transports {
+		bootstrapper, ok := t.(TransportBootstrapper)
+		if !ok {
+			continue
+		}
+		addrs, err := bootstrapper.Bootstrap(context.Background())
+		if err != nil {
+			log.Printf("Error bootstrapping from %s transport: %s\n", t.Scheme(), err)
+			continue
+		}
+		add(addrs)
+	}
+
+	add(fallbackSeedAddrs)
+
+	// dedup against what we already know about
+	var fresh []string
+	for _, addr := range candidates {
+		if !p.addrBook.Has(addr) {
+			fresh = append(fresh, addr)
+		}
+		if len(fresh) >= want {
+			break
+		}
+	}
+	for _, addr := range fresh {
+		if host, port, err := p.parsePeerAddress(addr); err == nil {
+			p.addrBook.Store(host + ":" + port)
+		}
+	}
+
+	// now attempt connections, bounded by a worker pool, until we either
+	// reach MinPeers or run out of addresses to try
+	toDial, err := p.addrBook.GetBiased(want, p.outboundPeerCount())
+	if err != nil {
+		log.Printf("Error sampling address book: %s\n", err)
+		return false
+	}
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, bootstrapWorkers)
+	for _, addr := range toDial {
+		if p.outboundPeerCount() >= p.minPeers {
+			break
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(addr string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			log.Printf("Bootstrapping connection to: %s\n", addr)
+			if err := p.connect(addr); err != nil {
+				log.Printf("Error connecting to peer: %s\n", err)
+			}
+		}(addr)
+	}
+	wg.Wait()
+
+	return p.outboundPeerCount() >= p.minPeers
+}
+
+// ensureIRC connects to the IRC bootstrap channel if IRC seeding is enabled
+// and we aren't connected yet, so peers it announces keep arriving on
+// p.addrChan for the lifetime of the PeerManager. It's called from every
+// bootstrapPass rather than once at startup, so a failed connection attempt
+// is retried alongside the other sources instead of being given up on for
+// good.
+func (p *PeerManager) ensureIRC() {
+	if !p.irc || len(p.peer) != 0 {
+		return
+	}
+
+	p.ircMu.Lock()
+	defer p.ircMu.Unlock()
+	if p.ircConn != nil {
+		return
+	}
+
+	port := p.advertisedPort()
+	_, open := p.externalIP()
+	if !open || !p.accept {
+		// don't advertise ourself as available for inbound connections
+		port = 0
+	}
+
+	conn := NewIRC()
+	if err := conn.Connect(p.genesisID, port, p.addrChan); err != nil {
+		log.Printf("Error connecting to IRC: %s\n", err)
+		return
+	}
+	conn.Run()
+	p.ircConn = conn
+}
+
+// signalWantMorePeers signals wantMorePeers, without blocking, whenever losing a peer might
+// have dropped us below MinPeers, so the bootstrapper doesn't have to wait
+// out its full backoff to notice.
+func (p *PeerManager) signalWantMorePeers() {
+	select {
+	case p.wantMorePeers <- struct{}{}:
+	default:
+	}
+}
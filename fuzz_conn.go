@@ -0,0 +1,138 @@
+// Copyright 2019 cruzbit developers
+// Use of this source code is governed by a MIT-style license that can be found in the LICENSE file.
+
+package cruzbit
+
+import (
+	"io"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// FuzzMode selects how FuzzConfig perturbs a connection.
+type FuzzMode int
+
+const (
+	// FuzzModeDrop randomly closes connections outright.
+	FuzzModeDrop FuzzMode = iota
+
+	// FuzzModeDelay randomly delays reads and writes.
+	FuzzModeDelay
+)
+
+// FuzzConfig enables chaos-testing of the peer-to-peer network by wrapping
+// every peer connection in a FuzzedConn. It's wired in via NewPeerManager and
+// meant for test harnesses, not production nodes: left nil, PeerManager
+// doesn't touch connections at all.
+type FuzzConfig struct {
+	// Mode selects how connections misbehave.
+	Mode FuzzMode
+
+	// Chance is the probability, in the range [0, 1], that a given read or
+	// write is affected.
+	Chance float64
+
+	// MaxDelay bounds how long a FuzzModeDelay read or write is held up.
+	MaxDelay time.Duration
+
+	// StartDelay holds off fuzzing until it elapses, so a test can let
+	// connections establish and a handshake complete before chaos starts.
+	StartDelay time.Duration
+
+	// Rand drives every fuzzing decision. Leave it nil for chaos that varies
+	// run to run; set it to a seeded *rand.Rand (e.g. rand.New(rand.NewSource(seed)))
+	// to make a fuzzed run reproducible.
+	Rand *rand.Rand
+
+	// randLock guards Rand, which is shared by every FuzzedConn wrapping a
+	// connection under this config and is otherwise unsafe for concurrent use.
+	randLock sync.Mutex
+}
+
+// roll reports whether this round should be fuzzed, and if so how long a
+// FuzzModeDelay should hold up the call. It's the only thing that touches
+// cfg.Rand, so that's the only place that needs to hold randLock.
+func (c *FuzzConfig) roll() (hit bool, delay time.Duration) {
+	c.randLock.Lock()
+	defer c.randLock.Unlock()
+	if c.Rand == nil {
+		c.Rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	if c.Rand.Float64() >= c.Chance {
+		return false, 0
+	}
+	return true, time.Duration(c.Rand.Int63n(int64(c.MaxDelay) + 1))
+}
+
+// FuzzedConn wraps a PeerConn and perturbs it per FuzzConfig. It implements
+// PeerConn so it's a drop-in replacement anywhere a transport's PeerConn
+// would otherwise be used.
+type FuzzedConn struct {
+	PeerConn
+	cfg     *FuzzConfig
+	started chan struct{}
+}
+
+// newFuzzedPeerConn wraps conn per cfg. cfg must not be nil. Fuzzing doesn't
+// activate until cfg.StartDelay has elapsed.
+func newFuzzedPeerConn(conn PeerConn, cfg *FuzzConfig) *FuzzedConn {
+	started := make(chan struct{})
+	time.AfterFunc(cfg.StartDelay, func() { close(started) })
+	return &FuzzedConn{PeerConn: conn, cfg: cfg, started: started}
+}
+
+// armed reports whether the configured start delay has elapsed.
+func (c *FuzzedConn) armed() bool {
+	select {
+	case <-c.started:
+		return true
+	default:
+		return false
+	}
+}
+
+// Header implements the optional header-carrying PeerConn interface by
+// forwarding to the wrapped connection, if it offers one.
+func (c *FuzzedConn) Header() http.Header {
+	if hc, ok := c.PeerConn.(interface{ Header() http.Header }); ok {
+		return hc.Header()
+	}
+	return nil
+}
+
+func (c *FuzzedConn) Read(b []byte) (int, error) {
+	if err := c.maybeFuzz(); err != nil {
+		return 0, err
+	}
+	return c.PeerConn.Read(b)
+}
+
+func (c *FuzzedConn) Write(b []byte) (int, error) {
+	if err := c.maybeFuzz(); err != nil {
+		return 0, err
+	}
+	return c.PeerConn.Write(b)
+}
+
+// maybeFuzz applies the configured mode with probability cfg.Chance, once
+// the start delay has elapsed. A non-nil return means the caller should
+// treat it as the I/O error.
+func (c *FuzzedConn) maybeFuzz() error {
+	if !c.armed() {
+		return nil
+	}
+	hit, delay := c.cfg.roll()
+	if !hit {
+		return nil
+	}
+	switch c.cfg.Mode {
+	case FuzzModeDrop:
+		c.PeerConn.Close()
+		return io.ErrClosedPipe
+	case FuzzModeDelay:
+		time.Sleep(delay)
+	}
+	return nil
+}
@@ -0,0 +1,216 @@
+// Copyright 2019 cruzbit developers
+// Use of this source code is governed by a MIT-style license that can be found in the LICENSE file.
+
+package cruzbit
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// natRenewInterval is how often NATManager renews its port mapping. Every
+// method is asked for a natLease-long mapping, so renewing well before the
+// shortest lease we request keeps the mapping from lapsing.
+const natRenewInterval = 5 * time.Minute
+
+// natProbeInterval is how often NATManager re-checks the external IP a
+// traversal method reports, so we notice a router getting a new WAN address
+// without needing a restart.
+const natProbeInterval = 10 * time.Minute
+
+// natLease is the lease duration requested from every traversal method
+// (NAT-PMP, PCP, and UPnP, which sends it as the mapping's lease duration).
+const natLease = 2 * natRenewInterval
+
+// NATTraversal is a single method of punching a hole through NAT and
+// learning our external IP: UPnP, NAT-PMP, or PCP.
+type NATTraversal interface {
+	// Name identifies the method for logging, e.g. "upnp", "nat-pmp", "pcp".
+	Name() string
+
+	// AddPortMapping maps externalPort on the gateway to internalPort on
+	// this host for protocol ("tcp" or "udp"), requesting the given lease
+	// where the method supports one. It returns the external port actually
+	// mapped, which may differ from the one requested.
+	AddPortMapping(ctx context.Context, protocol string, internalPort int, description string, lease time.Duration) (externalPort int, err error)
+
+	// DeletePortMapping removes a mapping previously created with AddPortMapping.
+	DeletePortMapping(ctx context.Context, protocol string, internalPort int) error
+
+	// ExternalIP returns the gateway's current external IP address.
+	ExternalIP(ctx context.Context) (string, error)
+}
+
+// NATManager tries a list of NATTraversal methods in order, keeps whichever
+// one works alive with periodic lease renewal, and periodically re-checks
+// the external IP so callers learn about a change without restarting.
+type NATManager struct {
+	methods     []NATTraversal
+	protocol    string
+	port        int
+	description string
+
+	mu         sync.Mutex
+	active     NATTraversal
+	externalIP string
+
+	onExternalIPChange func(ip string)
+
+	stopChan chan struct{}
+	wg       sync.WaitGroup
+}
+
+// NewNATManager returns a NATManager that will try methods, in order, to map
+// port for protocol ("tcp" or "udp") when Start is called.
+func NewNATManager(methods []NATTraversal, protocol string, port int, description string) *NATManager {
+	return &NATManager{
+		methods:     methods,
+		protocol:    protocol,
+		port:        port,
+		description: description,
+		stopChan:    make(chan struct{}),
+	}
+}
+
+// OnExternalIPChange registers a callback invoked whenever a periodic
+// re-probe finds our external IP has changed. It must be set before Start.
+func (m *NATManager) OnExternalIPChange(f func(ip string)) {
+	m.onExternalIPChange = f
+}
+
+// Start tries each configured method in order until one successfully maps
+// our port, then begins renewing the mapping and watching for IP changes in
+// the background. It returns the external IP and port on success.
+func (m *NATManager) Start(ctx context.Context) (externalIP string, externalPort int, err error) {
+	var lastErr error
+	for _, method := range m.methods {
+		port, err := method.AddPortMapping(ctx, m.protocol, m.port, m.description, natLease)
+		if err != nil {
+			log.Printf("NAT traversal via %s failed: %s\n", method.Name(), err)
+			lastErr = err
+			continue
+		}
+		ip, err := method.ExternalIP(ctx)
+		if err != nil {
+			log.Printf("NAT traversal via %s mapped a port but couldn't learn our external IP: %s\n",
+				method.Name(), err)
+			method.DeletePortMapping(ctx, m.protocol, m.port)
+			lastErr = err
+			continue
+		}
+
+		log.Printf("NAT traversal succeeded via %s: %s:%d\n", method.Name(), ip, port)
+		m.mu.Lock()
+		m.active = method
+		m.externalIP = ip
+		m.mu.Unlock()
+
+		m.wg.Add(1)
+		go m.run()
+		return ip, port, nil
+	}
+	return "", 0, fmt.Errorf("No NAT traversal method succeeded, last error: %s", lastErr)
+}
+
+func (m *NATManager) run() {
+	defer m.wg.Done()
+
+	renewTicker := time.NewTicker(natRenewInterval)
+	defer renewTicker.Stop()
+	probeTicker := time.NewTicker(natProbeInterval)
+	defer probeTicker.Stop()
+
+	for {
+		select {
+		case <-renewTicker.C:
+			m.mu.Lock()
+			method := m.active
+			m.mu.Unlock()
+			if _, err := method.AddPortMapping(context.Background(), m.protocol, m.port, m.description, natLease); err != nil {
+				log.Printf("Error renewing %s port mapping: %s\n", method.Name(), err)
+			}
+
+		case <-probeTicker.C:
+			m.mu.Lock()
+			method := m.active
+			lastIP := m.externalIP
+			m.mu.Unlock()
+
+			ip, err := method.ExternalIP(context.Background())
+			if err != nil {
+				log.Printf("Error re-probing external IP via %s: %s\n", method.Name(), err)
+				continue
+			}
+			if ip == lastIP {
+				continue
+			}
+			log.Printf("External IP changed from %s to %s\n", lastIP, ip)
+			m.mu.Lock()
+			m.externalIP = ip
+			m.mu.Unlock()
+			if m.onExternalIPChange != nil {
+				m.onExternalIPChange(ip)
+			}
+
+		case <-m.stopChan:
+			return
+		}
+	}
+}
+
+// ExternalIP returns the most recently learned external IP, or "" if
+// Start hasn't succeeded yet.
+func (m *NATManager) ExternalIP() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.externalIP
+}
+
+// localIPv4 returns this host's best guess at its LAN IPv4 address, which
+// UPnP and PCP need to tell the gateway where to forward mapped traffic.
+func localIPv4() string {
+	conn, err := net.Dial("udp", "8.8.8.8:80")
+	if err != nil {
+		return "127.0.0.1"
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP.String()
+}
+
+// defaultGatewayIP returns the LAN's default gateway IP, which NAT-PMP and
+// PCP speak to directly rather than relying on multicast discovery.
+func defaultGatewayIP() (net.IP, error) {
+	conn, err := net.Dial("udp", "8.8.8.8:80")
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	localIP := conn.LocalAddr().(*net.UDPAddr).IP.To4()
+	if localIP == nil {
+		return nil, fmt.Errorf("No local IPv4 address found")
+	}
+	// assume the conventional .1 gateway on the local /24, which covers the
+	// overwhelming majority of home and small-office routers
+	gw := make(net.IP, len(localIP))
+	copy(gw, localIP)
+	gw[3] = 1
+	return gw, nil
+}
+
+// Shutdown stops lease renewal and IP probing and deletes the port mapping.
+func (m *NATManager) Shutdown() error {
+	close(m.stopChan)
+	m.wg.Wait()
+
+	m.mu.Lock()
+	method := m.active
+	m.mu.Unlock()
+	if method == nil {
+		return nil
+	}
+	return method.DeletePortMapping(context.Background(), m.protocol, m.port)
+}
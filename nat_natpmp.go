@@ -0,0 +1,60 @@
+// Copyright 2019 cruzbit developers
+// Use of this source code is governed by a MIT-style license that can be found in the LICENSE file.
+
+package cruzbit
+
+import (
+	"context"
+	"net"
+	"time"
+
+	natpmp "github.com/jackpal/go-nat-pmp"
+)
+
+// NATPMPTraversal maps ports via Apple's NAT-PMP protocol, tried after UPnP
+// since it's mostly found on older Apple base stations and some routers
+// that don't support UPnP.
+type NATPMPTraversal struct {
+	client *natpmp.Client
+}
+
+// NewNATPMPTraversal builds a traversal that talks to the LAN's default
+// gateway over NAT-PMP.
+func NewNATPMPTraversal() (*NATPMPTraversal, error) {
+	gw, err := defaultGatewayIP()
+	if err != nil {
+		return nil, err
+	}
+	return &NATPMPTraversal{client: natpmp.NewClient(gw)}, nil
+}
+
+// Name implements NATTraversal.
+func (n *NATPMPTraversal) Name() string {
+	return "nat-pmp"
+}
+
+// AddPortMapping implements NATTraversal.
+func (n *NATPMPTraversal) AddPortMapping(ctx context.Context, protocol string, internalPort int, description string, lease time.Duration) (int, error) {
+	result, err := n.client.AddPortMapping(protocol, internalPort, internalPort, int(lease.Seconds()))
+	if err != nil {
+		return 0, err
+	}
+	return int(result.MappedExternalPort), nil
+}
+
+// DeletePortMapping implements NATTraversal. NAT-PMP has no explicit delete;
+// a mapping is removed by requesting a zero lifetime.
+func (n *NATPMPTraversal) DeletePortMapping(ctx context.Context, protocol string, internalPort int) error {
+	_, err := n.client.AddPortMapping(protocol, internalPort, internalPort, 0)
+	return err
+}
+
+// ExternalIP implements NATTraversal.
+func (n *NATPMPTraversal) ExternalIP(ctx context.Context) (string, error) {
+	result, err := n.client.GetExternalAddress()
+	if err != nil {
+		return "", err
+	}
+	ip := result.ExternalIPAddress
+	return net.IP(ip[:]).String(), nil
+}
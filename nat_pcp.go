@@ -0,0 +1,120 @@
+// Copyright 2019 cruzbit developers
+// Use of this source code is governed by a MIT-style license that can be found in the LICENSE file.
+
+package cruzbit
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+)
+
+// pcpPort is the well-known PCP server port (RFC 6887).
+const pcpPort = 5351
+
+// pcpOpMap is the PCP MAP opcode.
+const pcpOpMap = 1
+
+// PCPTraversal maps ports via the Port Control Protocol, the IETF successor
+// to NAT-PMP. It's tried last since it's the least commonly deployed of the
+// three.
+type PCPTraversal struct {
+	gateway net.IP
+}
+
+// NewPCPTraversal builds a traversal that speaks PCP to the LAN's default
+// gateway.
+func NewPCPTraversal() (*PCPTraversal, error) {
+	gw, err := defaultGatewayIP()
+	if err != nil {
+		return nil, err
+	}
+	return &PCPTraversal{gateway: gw}, nil
+}
+
+// Name implements NATTraversal.
+func (p *PCPTraversal) Name() string {
+	return "pcp"
+}
+
+// AddPortMapping implements NATTraversal by sending a PCP MAP request.
+func (p *PCPTraversal) AddPortMapping(ctx context.Context, protocol string, internalPort int, description string, lease time.Duration) (int, error) {
+	resp, err := p.request(protocol, internalPort, uint32(lease.Seconds()))
+	if err != nil {
+		return 0, err
+	}
+	return int(binary.BigEndian.Uint16(resp[42:44])), nil
+}
+
+// DeletePortMapping implements NATTraversal by sending a PCP MAP request
+// with a zero lifetime, which RFC 6887 defines as a deletion.
+func (p *PCPTraversal) DeletePortMapping(ctx context.Context, protocol string, internalPort int) error {
+	_, err := p.request(protocol, internalPort, 0)
+	return err
+}
+
+// ExternalIP implements NATTraversal by reading the assigned external
+// address back out of a zero-lifetime probe's response.
+func (p *PCPTraversal) ExternalIP(ctx context.Context) (string, error) {
+	resp, err := p.request("tcp", 0, 0)
+	if err != nil {
+		return "", err
+	}
+	return net.IP(resp[44:60]).String(), nil
+}
+
+// request builds and sends a minimal PCP MAP request and returns the raw
+// response packet. See RFC 6887 section 11 and 19.4 for the wire format;
+// this implements the third-party-free, map-only subset cruzbit needs.
+func (p *PCPTraversal) request(protocol string, internalPort int, lifetime uint32) ([]byte, error) {
+	conn, err := net.Dial("udp", fmt.Sprintf("%s:%d", p.gateway, pcpPort))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	local := conn.LocalAddr().(*net.UDPAddr).IP.To16()
+
+	req := make([]byte, 60)
+	req[0] = 2 // version 2
+	req[1] = pcpOpMap
+	binary.BigEndian.PutUint32(req[4:8], lifetime)
+	copy(req[8:24], local) // client IP, mapped to v4-in-v6
+
+	// mapping nonce: PCP requires one but doesn't care what it is as long as
+	// it's echoed back consistently across requests for the same mapping.
+	// It's a full 12 bytes (24-36), so the opcode-specific fields that
+	// follow start at 36, not 28.
+	binary.BigEndian.PutUint32(req[24:28], 0xc5c5c5c5)
+	binary.BigEndian.PutUint32(req[28:32], 0xc5c5c5c5)
+	binary.BigEndian.PutUint32(req[32:36], 0xc5c5c5c5)
+
+	proto := byte(6) // TCP
+	if protocol == "udp" {
+		proto = 17
+	}
+	req[36] = proto
+	binary.BigEndian.PutUint16(req[40:42], uint16(internalPort))
+	binary.BigEndian.PutUint16(req[42:44], uint16(internalPort)) // suggested external port
+	copy(req[44:60], local)                                      // suggested external IP
+
+	if _, err := conn.Write(req); err != nil {
+		return nil, err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp := make([]byte, 1100)
+	n, err := conn.Read(resp)
+	if err != nil {
+		return nil, err
+	}
+	if n < 60 {
+		return nil, fmt.Errorf("PCP response too short")
+	}
+	if resultCode := resp[3]; resultCode != 0 {
+		return nil, fmt.Errorf("PCP server returned error code %d", resultCode)
+	}
+	return resp[:n], nil
+}
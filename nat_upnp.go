@@ -0,0 +1,72 @@
+// Copyright 2019 cruzbit developers
+// Use of this source code is governed by a MIT-style license that can be found in the LICENSE file.
+
+package cruzbit
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/huin/goupnp/dcps/internetgateway2"
+)
+
+// UPnPTraversal maps ports via a UPnP Internet Gateway Device. Most
+// consumer routers advertise this, so it's tried first.
+type UPnPTraversal struct {
+	client *internetgateway2.WANIPConnection1
+}
+
+// NewUPnPTraversal discovers a UPnP gateway on the local network.
+func NewUPnPTraversal(ctx context.Context) (*UPnPTraversal, error) {
+	clients, _, err := internetgateway2.NewWANIPConnection1Clients()
+	if err != nil {
+		return nil, err
+	}
+	if len(clients) == 0 {
+		return nil, fmt.Errorf("No UPnP gateway found")
+	}
+	return &UPnPTraversal{client: clients[0]}, nil
+}
+
+// Name implements NATTraversal.
+func (u *UPnPTraversal) Name() string {
+	return "upnp"
+}
+
+// AddPortMapping implements NATTraversal. The requested lease is sent as the
+// mapping's lease duration; NATManager's periodic renewal refreshes it before
+// it lapses.
+func (u *UPnPTraversal) AddPortMapping(ctx context.Context, protocol string, internalPort int, description string, lease time.Duration) (int, error) {
+	err := u.client.AddPortMapping(
+		"", // remote host (any)
+		uint16(internalPort),
+		protocolUpper(protocol),
+		uint16(internalPort),
+		localIPv4(),
+		true, // enabled
+		description,
+		uint32(lease.Seconds()),
+	)
+	if err != nil {
+		return 0, err
+	}
+	return internalPort, nil
+}
+
+// DeletePortMapping implements NATTraversal.
+func (u *UPnPTraversal) DeletePortMapping(ctx context.Context, protocol string, internalPort int) error {
+	return u.client.DeletePortMapping("", uint16(internalPort), protocolUpper(protocol))
+}
+
+// ExternalIP implements NATTraversal.
+func (u *UPnPTraversal) ExternalIP(ctx context.Context) (string, error) {
+	return u.client.GetExternalIPAddress()
+}
+
+func protocolUpper(protocol string) string {
+	if protocol == "udp" {
+		return "UDP"
+	}
+	return "TCP"
+}
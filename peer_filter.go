@@ -0,0 +1,25 @@
+// Copyright 2019 cruzbit developers
+// Use of this source code is governed by a MIT-style license that can be found in the LICENSE file.
+
+package cruzbit
+
+import "net/http"
+
+// PeerFilter is consulted for every inbound and outbound peer connection
+// before it's allowed to proceed, letting operators plug in IP-range
+// blocklists, per-subnet connection caps, ASN-based filtering, or whatever
+// else without patching core code. headers is the handshake's HTTP headers
+// when the transport has any (currently only inbound WSS), or an empty Header
+// otherwise. Returning a non-nil error rejects the connection.
+type PeerFilter func(addr string, headers http.Header) error
+
+// applyFilters runs addr and headers through every configured filter,
+// stopping at the first rejection.
+func (p *PeerManager) applyFilters(addr string, headers http.Header) error {
+	for _, filter := range p.filters {
+		if err := filter(addr, headers); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -11,6 +11,7 @@ import (
 	"net"
 	"net/http"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -21,7 +22,8 @@ import (
 // It also manages finding peers to connect to.
 type PeerManager struct {
 	genesisID       BlockID
-	peerStore       PeerStorage
+	addrBook        *AddrBook
+	banlist         *Banlist
 	blockStore      BlockStorage
 	ledger          Ledger
 	processor       *Processor
@@ -30,6 +32,7 @@ type PeerManager struct {
 	myIP            string
 	peer            string
 	port            int
+	externalPort    int // port to advertise; differs from port when NAT maps us to a different external port
 	accept          bool
 	irc             bool
 	inPeers         map[string]*Peer
@@ -39,17 +42,36 @@ type PeerManager struct {
 	addrChan        chan string
 	peerNonce       string
 	open            bool
+	ipLock          sync.RWMutex
 	privateIPBlocks []*net.IPNet
-	server          *http.Server
+	transports      []Transport
+	minPeers        int
+	wantMorePeers   chan struct{}
+	nat             bool
+	natManager      *NATManager
+	ircMu           sync.Mutex
+	ircConn         *IRC
+	filters         []PeerFilter
+	fuzz            *FuzzConfig
 	shutdownChan    chan bool
 	wg              sync.WaitGroup
 }
 
-// NewPeerManager returns a new PeerManager instance.
+// NewPeerManager returns a new PeerManager instance. minPeers is the target
+// number of outbound connections the bootstrapper will try to maintain; pass
+// 0 to use DEFAULT_MIN_PEERS. If nat is true, myExternalIP is replaced by
+// whatever NATManager discovers once it succeeds. filters are consulted for every
+// inbound and outbound connection; fuzz may be nil to disable connection
+// fuzzing.
 func NewPeerManager(
-	genesisID BlockID, peerStore PeerStorage, blockStore BlockStorage,
+	genesisID BlockID, blockStore BlockStorage,
 	ledger Ledger, processor *Processor, txQueue TransactionQueue,
-	dataDir, myExternalIP, peer string, port int, accept, irc bool) *PeerManager {
+	dataDir, myExternalIP, peer string, port int, accept, irc, nat bool,
+	transports []Transport, minPeers int, filters []PeerFilter, fuzz *FuzzConfig) (*PeerManager, error) {
+
+	if minPeers <= 0 {
+		minPeers = DEFAULT_MIN_PEERS
+	}
 
 	// compute and save these
 	var privateIPBlocks []*net.IPNet
@@ -66,35 +88,68 @@ func NewPeerManager(
 		privateIPBlocks = append(privateIPBlocks, block)
 	}
 
-	// server to listen for and handle incoming secure WebSocket connections
-	server := &http.Server{
-		Addr:         "0.0.0.0:" + strconv.Itoa(port),
-		TLSConfig:    tlsServerConfig, // from tls.go
-		ReadTimeout:  10 * time.Second,
-		WriteTimeout: 10 * time.Second,
+	addrBook, err := NewAddrBook(dataDir)
+	if err != nil {
+		return nil, err
+	}
+
+	banlist, err := NewBanlist(dataDir)
+	if err != nil {
+		return nil, err
 	}
 
 	return &PeerManager{
 		genesisID:       genesisID,
-		peerStore:       peerStore,
+		addrBook:        addrBook,
+		banlist:         banlist,
 		blockStore:      blockStore,
 		ledger:          ledger,
 		processor:       processor,
 		txQueue:         txQueue,
 		dataDir:         dataDir,
-		myIP:            myExternalIP, // set if upnp was enabled and successful
+		myIP:            myExternalIP, // overridden by NATManager if nat is true
 		peer:            peer,
 		port:            port,
+		externalPort:    port, // overridden by startNAT if NAT maps us to a different external port
 		accept:          accept,
 		irc:             irc,
+		nat:             nat,
 		inPeers:         make(map[string]*Peer),
 		outPeers:        make(map[string]*Peer),
 		addrChan:        make(chan string, 10000),
 		peerNonce:       strconv.Itoa(int(rand.Int31())),
 		privateIPBlocks: privateIPBlocks,
-		server:          server,
+		transports:      transports,
+		minPeers:        minPeers,
+		wantMorePeers:   make(chan struct{}, 1),
+		filters:         filters,
+		fuzz:            fuzz,
 		shutdownChan:    make(chan bool),
+	}, nil
+}
+
+// transportForAddr picks which registered transport understands addr. Onion
+// addresses always route to the "tor" transport (and skip IP resolution and
+// the private-IP filter entirely, since Tor handles reachability itself);
+// everything else is untagged (assumed "wss") or tagged with the scheme a
+// transport other than wss/tor advertised it under (see taggedAddr), and is
+// routed to the transport whose Scheme() matches.
+func (p *PeerManager) transportForAddr(addr string) (Transport, error) {
+	if strings.HasSuffix(strings.ToLower(addr), ".onion") || strings.Contains(addr, ".onion:") {
+		for _, t := range p.transports {
+			if t.Scheme() == "tor" {
+				return t, nil
+			}
+		}
+		return nil, fmt.Errorf("No Tor transport configured for onion address: %s", addr)
+	}
+	scheme, _ := untagAddr(addr)
+	for _, t := range p.transports {
+		if t.Scheme() == scheme {
+			return t, nil
+		}
 	}
+	return nil, fmt.Errorf("No %s transport configured for address: %s", scheme, addr)
 }
 
 // Run executes the PeerManager's main loop in its own goroutine.
@@ -108,57 +163,48 @@ func (p *PeerManager) Run() {
 func (p *PeerManager) run() {
 	defer p.wg.Done()
 
-	// determine external ip
-	myExternalIP, err := determineExternalIP()
-	if err != nil {
-		log.Printf("Error determining external IP: %s\n", err)
+	if p.nat {
+		// try to map our port and learn our external IP ourselves, renewing
+		// the lease and watching for IP changes for as long as we run
+		p.startNAT()
 	} else {
-		log.Printf("My external IP address is: %s\n", myExternalIP)
-		if len(p.myIP) != 0 {
-			// if upnp enabled make sure the address returned matches the outside view
-			p.open = myExternalIP == p.myIP
+		// determine external ip
+		myExternalIP, err := determineExternalIP()
+		if err != nil {
+			log.Printf("Error determining external IP: %s\n", err)
 		} else {
-			// if no upnp see if any local routable ip matches the outside view
-			p.open, err = haveLocalIPMatch(myExternalIP)
-			if err != nil {
-				log.Printf("Error checking for local IP match: %s\n", err)
+			log.Printf("My external IP address is: %s\n", myExternalIP)
+			existingIP, _ := p.externalIP()
+			var open bool
+			if len(existingIP) != 0 {
+				// if upnp was already configured outside of us, make sure the
+				// address returned matches the outside view
+				open = myExternalIP == existingIP
+			} else {
+				// if no upnp see if any local routable ip matches the outside view
+				open, err = haveLocalIPMatch(myExternalIP)
+				if err != nil {
+					log.Printf("Error checking for local IP match: %s\n", err)
+				}
 			}
+			p.setExternalIP(myExternalIP, open)
 		}
-		p.myIP = myExternalIP
 	}
 
-	var irc *IRC
 	if len(p.peer) != 0 {
 		// store the explicitly specified outbound peer
-		if err := p.peerStore.Store(p.peer); err != nil {
+		if err := p.addrBook.Store(p.peer); err != nil {
 			log.Printf("Error saving peer: %s, address: %s\n", err, p.peer)
 		}
-	} else {
-		// handle IRC seeding
-		if p.irc == true {
-			port := p.port
-			if !p.open || !p.accept {
-				// don't advertise ourself as available for inbound connections
-				port = 0
-			}
-			irc = NewIRC()
-			if err := irc.Connect(p.genesisID, port, p.addrChan); err != nil {
-				log.Println(err)
-			} else {
-				irc.Run()
-			}
-		}
-
-		// query dns seeds for peers
-		addresses, err := dnsQueryForPeers()
-		if err != nil {
-			log.Printf("Error from DNS query: %s\n", err)
-		} else {
-			for _, addr := range addresses {
-				log.Printf("Got peer address from DNS: %s\n", addr)
-				p.addrChan <- addr
-			}
-		}
+	}
+	// IRC seeding, like DNS seeds, fallback seeds, and transport bootstrap
+	// sources, is handled continuously by peerBootstrapper below, rather than
+	// connected once here, so a failed attempt gets retried with the rest.
+
+	// keep us at MinPeers outbound connections for as long as we run, unless
+	// we were told to connect to one specific peer
+	if len(p.peer) == 0 {
+		p.bootstrap()
 	}
 
 	// handle incoming peers
@@ -193,7 +239,7 @@ func (p *PeerManager) run() {
 			// store the peer
 			resolvedAddr := host + ":" + port
 			log.Printf("Storing peer as: %s\n", resolvedAddr)
-			if err := p.peerStore.Store(resolvedAddr); err != nil {
+			if err := p.addrBook.Store(resolvedAddr); err != nil {
 				log.Printf("Error saving peer: %s, address: %s\n", err, resolvedAddr)
 				continue
 			}
@@ -209,13 +255,18 @@ func (p *PeerManager) run() {
 			if !ok {
 				log.Println("Peer manager shutting down...")
 
-				if irc != nil {
-					// shutdown irc
-					irc.Shutdown()
+				p.ircMu.Lock()
+				if p.ircConn != nil {
+					p.ircConn.Shutdown()
 				}
+				p.ircMu.Unlock()
 
-				// shutdown http server
-				p.server.Shutdown(context.Background())
+				// shutdown transports
+				for _, t := range p.transports {
+					if err := t.Shutdown(); err != nil {
+						log.Printf("Error shutting down %s transport: %s\n", t.Scheme(), err)
+					}
+				}
 				return
 			}
 		}
@@ -247,9 +298,131 @@ func (p *PeerManager) Shutdown() {
 		peer.Shutdown()
 	}
 
+	if p.natManager != nil {
+		if err := p.natManager.Shutdown(); err != nil {
+			log.Printf("Error releasing NAT port mapping: %s\n", err)
+		}
+	}
+
 	log.Println("Peer manager shutdown")
 }
 
+// startNAT tries UPnP, NAT-PMP, and PCP in order to map our listening port
+// and learn our external IP, then keeps the mapping alive and watches for
+// IP changes for as long as we run.
+func (p *PeerManager) startNAT() {
+	var methods []NATTraversal
+	if upnp, err := NewUPnPTraversal(context.Background()); err != nil {
+		log.Printf("UPnP unavailable: %s\n", err)
+	} else {
+		methods = append(methods, upnp)
+	}
+	if pmp, err := NewNATPMPTraversal(); err != nil {
+		log.Printf("NAT-PMP unavailable: %s\n", err)
+	} else {
+		methods = append(methods, pmp)
+	}
+	if pcp, err := NewPCPTraversal(); err != nil {
+		log.Printf("PCP unavailable: %s\n", err)
+	} else {
+		methods = append(methods, pcp)
+	}
+	if len(methods) == 0 {
+		log.Println("No NAT traversal method available")
+		return
+	}
+
+	natManager := NewNATManager(methods, "tcp", p.port, "cruzbit peer")
+	natManager.OnExternalIPChange(p.onExternalIPChange)
+
+	ip, port, err := natManager.Start(context.Background())
+	if err != nil {
+		log.Printf("NAT traversal failed: %s\n", err)
+		return
+	}
+
+	p.natManager = natManager
+	p.ipLock.Lock()
+	p.externalPort = port
+	p.ipLock.Unlock()
+	p.setExternalIP(ip, true)
+}
+
+// onExternalIPChange is called by NATManager whenever a periodic re-probe
+// finds our external IP has changed. It updates our advertised address and
+// tells connected peers about it, since the address we gave them on connect
+// is now stale.
+func (p *PeerManager) onExternalIPChange(ip string) {
+	p.setExternalIP(ip, true)
+	myAddress := ip + ":" + strconv.Itoa(p.advertisedPort())
+	log.Printf("Refreshing advertised address after external IP change: %s\n", myAddress)
+	p.gossipMyAddress(myAddress)
+}
+
+// setExternalIP updates our external IP and open (reachable-for-inbound)
+// state and, when open, refreshes every transport's advertised address to
+// match so a
+// future outbound connect() doesn't hand peers a stale Cruzbit-Peer-Address.
+// It's called from run() during startup and from onExternalIPChange, which
+// runs on NATManager's own goroutine, so it's guarded the same way the peer
+// sets are: connect, which reads both via externalIP, runs concurrently off
+// the bootstrap worker pool.
+func (p *PeerManager) setExternalIP(ip string, open bool) {
+	p.ipLock.Lock()
+	p.myIP = ip
+	p.open = open
+	p.ipLock.Unlock()
+
+	if !open {
+		return
+	}
+	myAddress := ip + ":" + strconv.Itoa(p.advertisedPort())
+	for _, t := range p.transports {
+		t.SetAdvertise(myAddress)
+	}
+}
+
+// advertisedPort returns the port to advertise ourself on: the port
+// NATManager actually mapped us to, if NAT traversal is in use, or our
+// listening port otherwise.
+func (p *PeerManager) advertisedPort() int {
+	p.ipLock.RLock()
+	defer p.ipLock.RUnlock()
+	return p.externalPort
+}
+
+// externalIP returns our current external IP and whether we're open for
+// inbound connections.
+func (p *PeerManager) externalIP() (string, bool) {
+	p.ipLock.RLock()
+	defer p.ipLock.RUnlock()
+	return p.myIP, p.open
+}
+
+// gossipMyAddress tells every connected peer our current address.
+func (p *PeerManager) gossipMyAddress(myAddress string) {
+	var peers []*Peer
+	func() {
+		p.outPeersLock.RLock()
+		defer p.outPeersLock.RUnlock()
+		for _, peer := range p.outPeers {
+			peers = append(peers, peer)
+		}
+	}()
+	func() {
+		p.inPeersLock.RLock()
+		defer p.inPeersLock.RUnlock()
+		for _, peer := range p.inPeers {
+			peers = append(peers, peer)
+		}
+	}()
+	for _, peer := range peers {
+		if err := peer.SendAddr(myAddress); err != nil {
+			log.Printf("Error gossiping address to peer: %s\n", err)
+		}
+	}
+}
+
 func (p *PeerManager) inboundPeerCount() int {
 	p.inPeersLock.RLock()
 	defer p.inPeersLock.RUnlock()
@@ -280,12 +453,13 @@ func (p *PeerManager) connectToPeers() error {
 		return nil
 	}
 
-	// otherwise try to keep us maximally connected
+	// otherwise try to keep us maximally connected, leaning on tried
+	// addresses more heavily the closer we already are to full
 	want := MAX_OUTBOUND_PEER_CONNECTIONS - p.outboundPeerCount()
 	if want <= 0 {
 		return nil
 	}
-	addrs, err := p.peerStore.Get(want)
+	addrs, err := p.addrBook.GetBiased(want, p.outboundPeerCount())
 	if err != nil {
 		return err
 	}
@@ -300,28 +474,62 @@ func (p *PeerManager) connectToPeers() error {
 	return nil
 }
 
-// Connect to a peer
+// Connect to a peer. addr may be scheme-tagged (see taggedAddr) if it was
+// learned from a transport other than wss/tor; dialAddr is always the bare
+// form the transport and bookkeeping outside the AddrBook deal in.
 func (p *PeerManager) connect(addr string) error {
-	peer := NewPeer(nil, p.genesisID, p.peerStore, p.blockStore, p.ledger, p.processor, p.txQueue, p.addrChan)
+	_, dialAddr := untagAddr(addr)
 
-	if ok := p.addToOutboundSet(addr, peer); !ok {
-		return fmt.Errorf("Too many peer connections")
+	if p.banlist.IsBanned(dialAddr) {
+		return fmt.Errorf("Peer is banned: %s", dialAddr)
 	}
 
-	var myAddress string
-	if p.open {
-		// advertise ourself as open
-		myAddress = p.myIP + ":" + strconv.Itoa(p.port)
+	if err := p.applyFilters(dialAddr, http.Header{}); err != nil {
+		return err
 	}
 
-	// connect to the peer
-	if err := peer.Connect(addr, p.peerNonce, myAddress); err != nil {
-		p.removeFromOutboundSet(addr)
+	transport, err := p.transportForAddr(addr)
+	if err != nil {
 		return err
 	}
 
+	// advertise the address peers on this transport can reach us at, if any
+	// (e.g. our onion address for TorTransport, or for WSSTransport and
+	// NoiseTransport the external address setExternalIP last handed them)
+	myAddress := transport.Advertise()
+
+	p.addrBook.MarkAttempt(addr)
+	conn, err := transport.Dial(context.Background(), dialAddr, p.peerNonce, myAddress)
+	if err != nil {
+		return err
+	}
+
+	if identity := conn.TheirIdentity(); p.banlist.IsIdentityBanned(identity) {
+		conn.Close()
+		return fmt.Errorf("Peer is banned: %s", identity)
+	}
+
+	p.addrBook.MarkGood(addr)
+
+	if p.fuzz != nil {
+		conn = newFuzzedPeerConn(conn, p.fuzz)
+	}
+
+	peer := NewPeer(conn, p.genesisID, p.addrBook, p.blockStore, p.ledger, p.processor, p.txQueue, p.addrChan)
+
+	if ok := p.addToOutboundSet(dialAddr, peer); !ok {
+		conn.Close()
+		return fmt.Errorf("Too many peer connections")
+	}
+
 	peer.OnClose(func() {
-		p.removeFromOutboundSet(addr)
+		p.removeFromOutboundSet(dialAddr)
+	})
+	peer.OnMisbehavior(func(reason string) {
+		p.banlist.Ban(dialAddr, reason, defaultBanDuration)
+		if identity := conn.TheirIdentity(); len(identity) != 0 {
+			p.banlist.BanIdentity(identity, reason, defaultBanDuration)
+		}
 	})
 	peer.Run()
 
@@ -330,19 +538,61 @@ func (p *PeerManager) connect(addr string) error {
 
 // Accept incoming peer connections
 func (p *PeerManager) acceptConnections() {
-	// handle incoming connection upgrade requests
-	peerHandler := func(w http.ResponseWriter, r *http.Request) {
-		// check the peer nonce
-		theirNonce := r.Header.Get("Cruzbit-Peer-Nonce")
-		if theirNonce == p.peerNonce {
-			log.Printf("Received connection with our own nonce")
-			// write back error reply
-			w.WriteHeader(http.StatusLoopDetected)
+	// schemes of transports that implement FilterableTransport and so already
+	// ran every connection through p.applyFilters before their handshake
+	// completed; peerHandler must not run those again post-handshake, or a
+	// stateful filter (e.g. one capping peers per /16) sees each connection
+	// twice and double-counts it
+	prefiltered := make(map[string]bool)
+	for _, t := range p.transports {
+		if _, ok := t.(FilterableTransport); ok {
+			prefiltered[t.Scheme()] = true
+		}
+	}
+
+	// handle a freshly accepted connection, regardless of which transport it
+	// arrived over
+	peerHandler := func(conn PeerConn) {
+		addr := conn.RemoteAddr().String()
+		if p.banlist.IsBanned(addr) {
+			log.Printf("Dropping inbound connection from banned peer: %s\n", addr)
+			conn.Close()
+			return
+		}
+
+		if identity := conn.TheirIdentity(); p.banlist.IsIdentityBanned(identity) {
+			log.Printf("Dropping inbound connection from banned peer: %s\n", identity)
+			conn.Close()
+			return
+		}
+
+		if conn.TheirNonce() == p.peerNonce {
+			log.Printf("Dropping connection looping back to ourself: %s\n", addr)
+			conn.Close()
 			return
 		}
 
-		// if they set their address it means they think they are open
-		theirAddress := r.Header.Get("Cruzbit-Peer-Address")
+		// transports implementing FilterableTransport already ran this
+		// connection through applyFilters pre-handshake; running it again
+		// here would apply a stateful filter's side effects twice
+		if !prefiltered[conn.Scheme()] {
+			var headers http.Header
+			if hc, ok := conn.(interface{ Header() http.Header }); ok {
+				headers = hc.Header()
+			}
+			if err := p.applyFilters(addr, headers); err != nil {
+				log.Printf("Rejecting connection from %s: %s\n", addr, err)
+				conn.Close()
+				return
+			}
+		}
+
+		if p.fuzz != nil {
+			conn = newFuzzedPeerConn(conn, p.fuzz)
+		}
+
+		// if they told us their address it means they think they are open
+		theirAddress := conn.TheirAddress()
 		if len(theirAddress) != 0 {
 			// parse, resolve and validate the address
 			host, port, err := p.parsePeerAddress(theirAddress)
@@ -359,55 +609,49 @@ func (p *PeerManager) acceptConnections() {
 				if p.existsInOutboundSet(theirAddress) {
 					log.Printf("Already connected to %s, dropping inbound connection",
 						theirAddress)
-					// write back error reply
-					w.WriteHeader(http.StatusTooManyRequests)
+					conn.Close()
 					return
 				}
 
-				// save their address for later use
-				if err := p.peerStore.Store(theirAddress); err != nil {
-					log.Printf("Error saving peer: %s, address: %s\n", err, theirAddress)
+				// save their address for later use, keyed to the inbound
+				// peer as its source, tagged with the transport it arrived
+				// on so a later outbound connect() dials it back over the
+				// same transport instead of guessing
+				taggedTheirAddress := taggedAddr(conn.Scheme(), theirAddress)
+				if err := p.addrBook.StoreWithSource(taggedTheirAddress, addr); err != nil {
+					log.Printf("Error saving peer: %s, address: %s\n", err, taggedTheirAddress)
 				}
 			}
 		}
 
-		// accept the new websocket
-		conn, err := PeerUpgrader.Upgrade(w, r, nil)
-		if err != nil {
-			log.Print("Upgrade:", err)
-			return
-		}
+		peer := NewPeer(conn, p.genesisID, p.addrBook, p.blockStore, p.ledger, p.processor, p.txQueue, p.addrChan)
 
-		peer := NewPeer(conn, p.genesisID, p.peerStore, p.blockStore, p.ledger, p.processor, p.txQueue, p.addrChan)
-
-		if ok := p.addToInboundSet(r.RemoteAddr, peer); !ok {
+		if ok := p.addToInboundSet(addr, peer); !ok {
 			// TODO: tell the peer why
 			peer.Shutdown()
 			return
 		}
 
-		addr := conn.RemoteAddr().String()
 		log.Printf("New peer connection from: %s", addr)
 		peer.OnClose(func() {
 			p.removeFromInboundSet(addr)
 		})
+		peer.OnMisbehavior(func(reason string) {
+			p.banlist.Ban(addr, reason, defaultBanDuration)
+			if identity := conn.TheirIdentity(); len(identity) != 0 {
+				p.banlist.BanIdentity(identity, reason, defaultBanDuration)
+			}
+		})
 		peer.Run()
 	}
 
-	// generate new certificate and key for tls on each run
-	log.Println("Generating TLS certificate and key")
-	certPath, keyPath, err := generateSelfSignedCertAndKey(p.dataDir)
-	if err != nil {
-		log.Println(err)
-		return
-	}
-
-	// listen for websocket requests using the genesis block ID as the handler pattern
-	http.HandleFunc("/"+p.genesisID.String(), peerHandler)
-
-	log.Println("Listening for new peer connections")
-	if err := p.server.ListenAndServeTLS(certPath, keyPath); err != nil {
-		log.Println(err)
+	for _, t := range p.transports {
+		if ft, ok := t.(FilterableTransport); ok {
+			ft.SetFilter(p.applyFilters)
+		}
+		if err := t.Listen(context.Background(), p.genesisID, peerHandler); err != nil {
+			log.Printf("Error starting %s transport: %s\n", t.Scheme(), err)
+		}
 	}
 }
 
@@ -459,6 +703,7 @@ func (p *PeerManager) removeFromOutboundSet(addr string) {
 	defer p.outPeersLock.Unlock()
 	delete(p.outPeers, addr)
 	log.Printf("Outbound peer count: %d\n", len(p.outPeers))
+	p.signalWantMorePeers()
 }
 
 // Helper to remove peers from the inbound set
@@ -482,6 +727,12 @@ func (p *PeerManager) parsePeerAddress(addr string) (string, string, error) {
 		return "", "", fmt.Errorf("Invalid port in peer address: %s", addr)
 	}
 
+	if strings.HasSuffix(strings.ToLower(host), ".onion") {
+		// onion addresses aren't resolvable or subject to the private-IP
+		// filter below; Tor itself is responsible for routing to them
+		return host, port, nil
+	}
+
 	// resolve the host to an ip
 	ips, err := net.LookupIP(host)
 	if err != nil {
@@ -492,7 +743,7 @@ func (p *PeerManager) parsePeerAddress(addr string) (string, string, error) {
 	}
 
 	// don't accept ourself
-	if p.myIP == ips[0].String() && p.port == int(portInt) {
+	if myIP, _ := p.externalIP(); myIP == ips[0].String() && p.advertisedPort() == int(portInt) {
 		return "", "", fmt.Errorf("Peer address is ours: %s", addr)
 	}
 
@@ -541,4 +792,4 @@ func determineExternalIP() (string, error) {
 		return "", err
 	}
 	return ip.String(), nil
-}
\ No newline at end of file
+}
@@ -0,0 +1,199 @@
+// Copyright 2019 cruzbit developers
+// Use of this source code is governed by a MIT-style license that can be found in the LICENSE file.
+
+package cruzbit
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Transport abstracts how PeerManager listens for and dials peer connections.
+// This lets us run several different ways of reaching peers (secure WebSocket,
+// a Tor hidden service, a Noise-authenticated TCP link, ...) side by side
+// without PeerManager's connection bookkeeping knowing which one is in play.
+type Transport interface {
+	// Scheme returns a short identifier for the transport, e.g. "wss", "tor", "noise".
+	// It's used to route an address (via transportForAddr) to the transport that
+	// understands it and to tag addresses learned over it (see taggedAddr).
+	Scheme() string
+
+	// Listen starts accepting inbound connections for genesisID and returns
+	// once the listener is up. Accepted connections are handed to handler
+	// after whatever handshake the transport requires has completed.
+	Listen(ctx context.Context, genesisID BlockID, handler func(PeerConn)) error
+
+	// Dial establishes an outbound connection to addr, performing the
+	// transport's handshake and exchanging our nonce/address with the peer.
+	Dial(ctx context.Context, addr, nonce, myAddr string) (PeerConn, error)
+
+	// Advertise returns the address other peers should use to reach us over
+	// this transport, or "" if we have nothing to advertise yet.
+	Advertise() string
+
+	// SetAdvertise updates the address returned by Advertise, e.g. once our
+	// external IP is learned after startup or changes later via NAT
+	// re-probing. Transports with a fixed identity (e.g. TorTransport's onion
+	// address) may implement this as a no-op.
+	SetAdvertise(addr string)
+
+	// Shutdown releases any resources (listeners, control connections, etc.)
+	// held by the transport.
+	Shutdown() error
+}
+
+// FilterableTransport is implemented by transports that can reject a
+// connection before completing their handshake, based on the PeerFilter
+// chain PeerManager wires up via SetFilter. A Transport that doesn't
+// implement it is simply filtered later, once PeerManager sees the
+// handshaked PeerConn.
+type FilterableTransport interface {
+	SetFilter(filter PeerFilter)
+}
+
+// TransportBootstrapper is implemented by transports that can suggest their
+// own candidate peer addresses (e.g. a list of known-good onion seeds), on
+// top of the DNS/IRC/fallback sources the bootstrapper already queries. A
+// Transport that has nothing to add simply doesn't implement it.
+type TransportBootstrapper interface {
+	Bootstrap(ctx context.Context) ([]string, error)
+}
+
+// PeerConn is the connection handed to a Transport's accept handler or
+// returned by its Dial. It's a net.Conn plus whatever address the peer
+// told us about itself during the transport handshake, so PeerManager
+// doesn't need transport-specific knowledge to wire it into a Peer.
+type PeerConn interface {
+	net.Conn
+
+	// TheirAddress is the address the remote peer claims to be reachable at,
+	// or "" if they didn't offer one.
+	TheirAddress() string
+
+	// TheirNonce is the nonce the remote peer sent us during the transport
+	// handshake. PeerManager compares it against its own peerNonce to detect
+	// a connection looping back to ourself.
+	TheirNonce() string
+
+	// TheirIdentity is a stable identifier for the remote peer that survives
+	// them reconnecting from a new address: a hex-encoded static public key
+	// for NoiseTransport, the claimed .onion address for TorTransport (whose
+	// RemoteAddr is always Tor's local forwarding socket, not the peer), or
+	// "" for transports with no persistent peer identity (WSS). PeerManager
+	// bans on this in addition to the address whenever it's available.
+	TheirIdentity() string
+
+	// Scheme is the Transport.Scheme() of whichever transport produced this
+	// connection. PeerManager tags an address learned from TheirAddress with
+	// it before storing the address, so a later outbound connect() routes
+	// back to the same transport instead of guessing.
+	Scheme() string
+}
+
+// taggedAddr prefixes addr with "scheme://" so it can be routed back to the
+// transport that produced it. "wss" and "tor" are left untagged: wss is the
+// scheme every pre-existing address (DNS/fallback seeds, the --peer flag,
+// older AddrBook entries) is assumed to be, and tor addresses are already
+// unambiguous thanks to their ".onion" suffix. Only a transport sharing that
+// address shape with another, like noise, actually needs the prefix.
+func taggedAddr(scheme, addr string) string {
+	if scheme == "" || scheme == "wss" || scheme == "tor" {
+		return addr
+	}
+	return scheme + "://" + addr
+}
+
+// untagAddr splits a possibly-taggedAddr address back into its scheme and
+// bare address, defaulting the scheme to "wss" when addr carries no tag.
+func untagAddr(addr string) (scheme, bare string) {
+	if i := strings.Index(addr, "://"); i != -1 {
+		return addr[:i], addr[i+len("://"):]
+	}
+	return "wss", addr
+}
+
+// basicPeerConn is a net.Conn paired with a peer-supplied address, nonce,
+// identity, and scheme and, for transports built on HTTP, the handshake's
+// headers. It's sufficient for every transport cruzbit ships.
+type basicPeerConn struct {
+	net.Conn
+	theirAddress  string
+	theirNonce    string
+	theirIdentity string
+	scheme        string
+	header        http.Header
+}
+
+func (c *basicPeerConn) TheirAddress() string {
+	return c.theirAddress
+}
+
+func (c *basicPeerConn) Scheme() string {
+	return c.scheme
+}
+
+func (c *basicPeerConn) TheirNonce() string {
+	return c.theirNonce
+}
+
+func (c *basicPeerConn) TheirIdentity() string {
+	return c.theirIdentity
+}
+
+// Header returns the HTTP headers the connection was upgraded from, or nil
+// for transports that aren't HTTP-based. PeerFilter callers type-assert for
+// this rather than it being part of the PeerConn interface, since most
+// transports have nothing to offer here.
+func (c *basicPeerConn) Header() http.Header {
+	return c.header
+}
+
+// sendPeerHello and recvPeerHello exchange our nonce/address with the peer
+// over transports that don't have an HTTP handshake to carry them in
+// headers (WSSTransport uses Cruzbit-Peer-Nonce/Cruzbit-Peer-Address
+// instead). Each value is framed with a 2-byte length prefix, matching the
+// framing NoiseTransport's handshake already uses for its own frames.
+func sendPeerHello(conn net.Conn, nonce, myAddr string) error {
+	if err := writeLengthPrefixed(conn, []byte(nonce)); err != nil {
+		return err
+	}
+	return writeLengthPrefixed(conn, []byte(myAddr))
+}
+
+func recvPeerHello(conn net.Conn) (nonce, theirAddr string, err error) {
+	n, err := readLengthPrefixed(conn)
+	if err != nil {
+		return "", "", err
+	}
+	a, err := readLengthPrefixed(conn)
+	if err != nil {
+		return "", "", err
+	}
+	return string(n), string(a), nil
+}
+
+func writeLengthPrefixed(conn net.Conn, b []byte) error {
+	var lenPrefix [2]byte
+	binary.BigEndian.PutUint16(lenPrefix[:], uint16(len(b)))
+	if _, err := conn.Write(lenPrefix[:]); err != nil {
+		return err
+	}
+	_, err := conn.Write(b)
+	return err
+}
+
+func readLengthPrefixed(conn net.Conn) ([]byte, error) {
+	var lenPrefix [2]byte
+	if _, err := io.ReadFull(conn, lenPrefix[:]); err != nil {
+		return nil, err
+	}
+	b := make([]byte, binary.BigEndian.Uint16(lenPrefix[:]))
+	if _, err := io.ReadFull(conn, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
@@ -0,0 +1,387 @@
+// Copyright 2019 cruzbit developers
+// Use of this source code is governed by a MIT-style license that can be found in the LICENSE file.
+
+package cruzbit
+
+import (
+	"context"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+)
+
+// NoiseTransport is a Brontide-style authenticated transport: rather than the
+// throwaway self-signed certificate WSSTransport generates on every run, each
+// node has a stable static ed25519 identity key, and a lightweight
+// Noise-inspired handshake derives a session key used to encrypt the link.
+// This gives peers a persistent identity to pin to, independent of whatever
+// address they're currently reachable at.
+type NoiseTransport struct {
+	dataDir  string
+	port     int
+	identity ed25519.PrivateKey
+	listener net.Listener
+	filter   PeerFilter
+
+	addrMu    sync.RWMutex
+	myAddress string
+}
+
+// SetFilter implements FilterableTransport.
+func (t *NoiseTransport) SetFilter(filter PeerFilter) {
+	t.filter = filter
+}
+
+// NewNoiseTransport returns a new NoiseTransport, loading its static identity
+// key from dataDir or generating and persisting one if none exists yet.
+func NewNoiseTransport(dataDir, myAddress string, port int) (*NoiseTransport, error) {
+	identity, err := loadOrCreateNoiseIdentity(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	return &NoiseTransport{
+		dataDir:   dataDir,
+		myAddress: myAddress,
+		port:      port,
+		identity:  identity,
+	}, nil
+}
+
+// Scheme implements Transport.
+func (t *NoiseTransport) Scheme() string {
+	return "noise"
+}
+
+// Advertise implements Transport.
+func (t *NoiseTransport) Advertise() string {
+	t.addrMu.RLock()
+	defer t.addrMu.RUnlock()
+	return t.myAddress
+}
+
+// SetAdvertise implements Transport.
+func (t *NoiseTransport) SetAdvertise(addr string) {
+	t.addrMu.Lock()
+	defer t.addrMu.Unlock()
+	t.myAddress = addr
+}
+
+// Listen implements Transport.
+func (t *NoiseTransport) Listen(ctx context.Context, genesisID BlockID, handler func(PeerConn)) error {
+	ln, err := net.Listen("tcp", "0.0.0.0:"+strconv.Itoa(t.port))
+	if err != nil {
+		return err
+	}
+	t.listener = ln
+
+	log.Printf("Listening for new peer connections (noise), identity %s\n",
+		hex.EncodeToString(t.identity.Public().(ed25519.PublicKey)))
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			if t.filter != nil {
+				if err := t.filter(conn.RemoteAddr().String(), http.Header{}); err != nil {
+					log.Printf("Rejecting connection from %s: %s\n", conn.RemoteAddr(), err)
+					conn.Close()
+					continue
+				}
+			}
+			go func() {
+				nc, theirIdentity, err := noiseRespond(conn, t.identity)
+				if err != nil {
+					log.Printf("Noise handshake failed: %s\n", err)
+					conn.Close()
+					return
+				}
+				theirNonce, theirAddress, err := recvPeerHello(nc)
+				if err != nil {
+					log.Printf("Error reading peer hello: %s\n", err)
+					conn.Close()
+					return
+				}
+				handler(&basicPeerConn{
+					Conn:          nc,
+					theirAddress:  theirAddress,
+					theirNonce:    theirNonce,
+					theirIdentity: theirIdentity,
+					scheme:        t.Scheme(),
+				})
+			}()
+		}
+	}()
+	return nil
+}
+
+// Dial implements Transport.
+func (t *NoiseTransport) Dial(ctx context.Context, addr, nonce, myAddr string) (PeerConn, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	nc, theirIdentity, err := noiseInitiate(conn, t.identity)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := sendPeerHello(nc, nonce, myAddr); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &basicPeerConn{Conn: nc, theirIdentity: theirIdentity, scheme: t.Scheme()}, nil
+}
+
+// Shutdown implements Transport.
+func (t *NoiseTransport) Shutdown() error {
+	if t.listener != nil {
+		return t.listener.Close()
+	}
+	return nil
+}
+
+func loadOrCreateNoiseIdentity(dataDir string) (ed25519.PrivateKey, error) {
+	path := filepath.Join(dataDir, "noise_identity.key")
+	if b, err := ioutil.ReadFile(path); err == nil {
+		if len(b) != ed25519.PrivateKeySize {
+			return nil, fmt.Errorf("Corrupt noise identity key: %s", path)
+		}
+		return ed25519.PrivateKey(b), nil
+	}
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(path, priv, 0600); err != nil {
+		return nil, err
+	}
+	return priv, nil
+}
+
+// maxNoiseFrameSize bounds a single noiseConn frame (ciphertext plus its
+// chacha20poly1305 tag), comfortably above cruzbit's largest block messages
+// while keeping a malicious length prefix from triggering a huge allocation.
+const maxNoiseFrameSize = 16 * 1024 * 1024
+
+// noiseConn wraps a net.Conn with chacha20poly1305 framing using a key
+// established by the handshake below.
+type noiseConn struct {
+	net.Conn
+	send      cipher.AEAD
+	recv      cipher.AEAD
+	sendNonce uint64
+	recvNonce uint64
+	readBuf   []byte
+}
+
+func newNoiseConn(conn net.Conn, sendKey, recvKey [32]byte) (*noiseConn, error) {
+	send, err := chacha20poly1305.New(sendKey[:])
+	if err != nil {
+		return nil, err
+	}
+	recv, err := chacha20poly1305.New(recvKey[:])
+	if err != nil {
+		return nil, err
+	}
+	return &noiseConn{Conn: conn, send: send, recv: recv}, nil
+}
+
+func (c *noiseConn) nonceBytes(n uint64) []byte {
+	b := make([]byte, chacha20poly1305.NonceSize)
+	binary.LittleEndian.PutUint64(b[4:], n)
+	return b
+}
+
+func (c *noiseConn) Write(p []byte) (int, error) {
+	if len(p)+chacha20poly1305.Overhead > maxNoiseFrameSize {
+		return 0, fmt.Errorf("Noise frame too large to send: %d bytes", len(p))
+	}
+
+	ct := c.send.Seal(nil, c.nonceBytes(c.sendNonce), p, nil)
+	c.sendNonce++
+
+	var lenPrefix [4]byte
+	binary.BigEndian.PutUint32(lenPrefix[:], uint32(len(ct)))
+	if _, err := c.Conn.Write(lenPrefix[:]); err != nil {
+		return 0, err
+	}
+	if _, err := c.Conn.Write(ct); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *noiseConn) Read(p []byte) (int, error) {
+	if len(c.readBuf) == 0 {
+		var lenPrefix [4]byte
+		if _, err := io.ReadFull(c.Conn, lenPrefix[:]); err != nil {
+			return 0, err
+		}
+		ctLen := binary.BigEndian.Uint32(lenPrefix[:])
+		if ctLen > maxNoiseFrameSize {
+			return 0, fmt.Errorf("Noise frame too large to receive: %d bytes", ctLen)
+		}
+		ct := make([]byte, ctLen)
+		if _, err := io.ReadFull(c.Conn, ct); err != nil {
+			return 0, err
+		}
+		pt, err := c.recv.Open(nil, c.nonceBytes(c.recvNonce), ct, nil)
+		if err != nil {
+			return 0, fmt.Errorf("Noise frame authentication failed: %s", err)
+		}
+		c.recvNonce++
+		c.readBuf = pt
+	}
+	n := copy(p, c.readBuf)
+	c.readBuf = c.readBuf[n:]
+	return n, nil
+}
+
+// noiseInitiate performs the handshake's dialing side: exchange ephemeral
+// x25519 keys, sign our ephemeral public key with our static ed25519
+// identity so the responder can authenticate us, and derive the two directional session
+// keys from the shared secret.
+func noiseInitiate(conn net.Conn, identity ed25519.PrivateKey) (nc *noiseConn, theirIdentity string, err error) {
+	ephPub, ephPriv, err := newX25519Keypair()
+	if err != nil {
+		return nil, "", err
+	}
+
+	if err := writeLengthPrefixed(conn, ephPub[:]); err != nil {
+		return nil, "", err
+	}
+	sig := ed25519.Sign(identity, ephPub[:])
+	if err := writeLengthPrefixed(conn, append(identity.Public().(ed25519.PublicKey), sig...)); err != nil {
+		return nil, "", err
+	}
+
+	theirEphPub, err := readLengthPrefixed(conn)
+	if err != nil {
+		return nil, "", err
+	}
+	theirAuth, err := readLengthPrefixed(conn)
+	if err != nil {
+		return nil, "", err
+	}
+	theirPub, err := verifyNoiseAuth(theirAuth, theirEphPub)
+	if err != nil {
+		return nil, "", err
+	}
+
+	shared, err := curve25519.X25519(ephPriv[:], theirEphPub)
+	if err != nil {
+		return nil, "", err
+	}
+	sendKey, recvKey := deriveNoiseKeys(shared, ephPub[:], theirEphPub)
+	nc, err = newNoiseConn(conn, sendKey, recvKey)
+	if err != nil {
+		return nil, "", err
+	}
+	return nc, hex.EncodeToString(theirPub), nil
+}
+
+// noiseRespond is the accepting side's mirror of noiseInitiate.
+func noiseRespond(conn net.Conn, identity ed25519.PrivateKey) (nc *noiseConn, theirIdentity string, err error) {
+	theirEphPub, err := readLengthPrefixed(conn)
+	if err != nil {
+		return nil, "", err
+	}
+	theirAuth, err := readLengthPrefixed(conn)
+	if err != nil {
+		return nil, "", err
+	}
+	theirPub, err := verifyNoiseAuth(theirAuth, theirEphPub)
+	if err != nil {
+		return nil, "", err
+	}
+
+	ephPub, ephPriv, err := newX25519Keypair()
+	if err != nil {
+		return nil, "", err
+	}
+	if err := writeLengthPrefixed(conn, ephPub[:]); err != nil {
+		return nil, "", err
+	}
+	sig := ed25519.Sign(identity, ephPub[:])
+	if err := writeLengthPrefixed(conn, append(identity.Public().(ed25519.PublicKey), sig...)); err != nil {
+		return nil, "", err
+	}
+
+	shared, err := curve25519.X25519(ephPriv[:], theirEphPub)
+	if err != nil {
+		return nil, "", err
+	}
+	// the responder's send key is the initiator's recv key, so derive in the
+	// opposite order from noiseInitiate
+	recvKey, sendKey := deriveNoiseKeys(shared, theirEphPub, ephPub[:])
+	nc, err = newNoiseConn(conn, sendKey, recvKey)
+	if err != nil {
+		return nil, "", err
+	}
+	return nc, hex.EncodeToString(theirPub), nil
+}
+
+// verifyNoiseAuth checks auth's ed25519 signature over ephPub and returns the
+// signer's public key, which is the peer's authenticated static identity.
+func verifyNoiseAuth(auth, ephPub []byte) (ed25519.PublicKey, error) {
+	if len(auth) != ed25519.PublicKeySize+ed25519.SignatureSize {
+		return nil, fmt.Errorf("Malformed noise auth frame")
+	}
+	pub := ed25519.PublicKey(auth[:ed25519.PublicKeySize])
+	sig := auth[ed25519.PublicKeySize:]
+	if !ed25519.Verify(pub, ephPub, sig) {
+		return nil, fmt.Errorf("Noise handshake signature verification failed")
+	}
+	return pub, nil
+}
+
+func newX25519Keypair() (pub, priv [32]byte, err error) {
+	if _, err = io.ReadFull(rand.Reader, priv[:]); err != nil {
+		return
+	}
+	p, err := curve25519.X25519(priv[:], curve25519.Basepoint)
+	if err != nil {
+		return
+	}
+	copy(pub[:], p)
+	return
+}
+
+// deriveNoiseKeys derives distinct send/recv keys for the two ends of the
+// link from the shared secret and both ephemeral public keys, so a reflected
+// packet never decrypts under the key it was encrypted with.
+func deriveNoiseKeys(shared, initiatorEphPub, responderEphPub []byte) (sendKey, recvKey [32]byte) {
+	copy(sendKey[:], hkdfLite(shared, append(append([]byte{}, initiatorEphPub...), responderEphPub...)))
+	copy(recvKey[:], hkdfLite(shared, append(append([]byte{}, responderEphPub...), initiatorEphPub...)))
+	return
+}
+
+// hkdfLite is a minimal single-block HMAC-SHA256 key derivation, sufficient
+// for pulling a 32-byte key out of the handshake's shared secret. It's not a
+// full RFC 5869 HKDF (no separate extract/expand, single block only), but
+// that's all one chacha20poly1305 key needs.
+func hkdfLite(secret, info []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(info)
+	return mac.Sum(nil)
+}
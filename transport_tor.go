@@ -0,0 +1,218 @@
+// Copyright 2019 cruzbit developers
+// Use of this source code is governed by a MIT-style license that can be found in the LICENSE file.
+
+package cruzbit
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/proxy"
+)
+
+// TorTransport reaches peers over a v3 onion service. Inbound connections
+// are accepted on a local port that the Tor daemon forwards traffic to after
+// we ask it (over its control port) to publish a hidden service pointing at
+// that port. Outbound connections to ".onion" addresses are dialed through
+// the daemon's SOCKS5 proxy.
+type TorTransport struct {
+	controlAddr string // e.g. "127.0.0.1:9051"
+	socksAddr   string // e.g. "127.0.0.1:9050"
+	controlPass string // empty if the control port has no authentication
+
+	listenPort int
+	onionAddr  string // set once Listen has created the hidden service
+
+	listener net.Listener
+	ctrl     net.Conn
+	filter   PeerFilter
+}
+
+// SetFilter implements FilterableTransport.
+func (t *TorTransport) SetFilter(filter PeerFilter) {
+	t.filter = filter
+}
+
+// NewTorTransport returns a new TorTransport that talks to a local Tor
+// instance via controlAddr/socksAddr.
+func NewTorTransport(controlAddr, socksAddr, controlPass string, listenPort int) *TorTransport {
+	return &TorTransport{
+		controlAddr: controlAddr,
+		socksAddr:   socksAddr,
+		controlPass: controlPass,
+		listenPort:  listenPort,
+	}
+}
+
+// Scheme implements Transport.
+func (t *TorTransport) Scheme() string {
+	return "tor"
+}
+
+// Advertise implements Transport.
+func (t *TorTransport) Advertise() string {
+	return t.onionAddr
+}
+
+// SetAdvertise implements Transport. It's a no-op: our onion address is
+// fixed for the life of the hidden service, unlike a WSS/Noise address which
+// tracks a learned or changing external IP.
+func (t *TorTransport) SetAdvertise(addr string) {}
+
+// Listen implements Transport.
+func (t *TorTransport) Listen(ctx context.Context, genesisID BlockID, handler func(PeerConn)) error {
+	ctrl, err := net.Dial("tcp", t.controlAddr)
+	if err != nil {
+		return fmt.Errorf("Unable to reach Tor control port: %s", err)
+	}
+	t.ctrl = ctrl
+
+	if err := torAuthenticate(ctrl, t.controlPass); err != nil {
+		ctrl.Close()
+		return err
+	}
+
+	ln, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", t.listenPort))
+	if err != nil {
+		ctrl.Close()
+		return err
+	}
+	t.listener = ln
+	localPort := ln.Addr().(*net.TCPAddr).Port
+
+	serviceID, err := torAddOnion(ctrl, t.listenPort, localPort)
+	if err != nil {
+		ln.Close()
+		ctrl.Close()
+		return err
+	}
+	t.onionAddr = fmt.Sprintf("%s.onion:%d", serviceID, t.listenPort)
+	log.Printf("Tor hidden service published at %s\n", t.onionAddr)
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			if t.filter != nil {
+				if err := t.filter(conn.RemoteAddr().String(), http.Header{}); err != nil {
+					log.Printf("Rejecting connection from %s: %s\n", conn.RemoteAddr(), err)
+					conn.Close()
+					continue
+				}
+			}
+			go func() {
+				theirNonce, theirAddress, err := recvPeerHello(conn)
+				if err != nil {
+					log.Printf("Error reading peer hello: %s\n", err)
+					conn.Close()
+					return
+				}
+				// RemoteAddr is always the local 127.0.0.1 socket Tor
+				// forwards hidden-service traffic to, never the actual
+				// remote peer, so their claimed onion address is the only
+				// thing that can stand in as a stable per-peer identity.
+				handler(&basicPeerConn{
+					Conn:          conn,
+					theirAddress:  theirAddress,
+					theirNonce:    theirNonce,
+					theirIdentity: theirAddress,
+					scheme:        t.Scheme(),
+				})
+			}()
+		}
+	}()
+	return nil
+}
+
+// Dial implements Transport.
+func (t *TorTransport) Dial(ctx context.Context, addr, nonce, myAddr string) (PeerConn, error) {
+	dialer, err := proxy.SOCKS5("tcp", t.socksAddr, nil, proxy.Direct)
+	if err != nil {
+		return nil, err
+	}
+	contextDialer, ok := dialer.(proxy.ContextDialer)
+	if !ok {
+		return nil, fmt.Errorf("SOCKS5 dialer doesn't support contexts")
+	}
+	conn, err := contextDialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if err := sendPeerHello(conn, nonce, myAddr); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// addr is the .onion address we dialed, which doubles as their identity.
+	return &basicPeerConn{Conn: conn, theirIdentity: addr, scheme: t.Scheme()}, nil
+}
+
+// Shutdown implements Transport.
+func (t *TorTransport) Shutdown() error {
+	if t.listener != nil {
+		t.listener.Close()
+	}
+	if t.ctrl != nil {
+		t.ctrl.Close()
+	}
+	return nil
+}
+
+// torAuthenticate completes a minimal AUTHENTICATE handshake against the Tor
+// control port, using the password if one was configured, else falling back
+// to the NULL authentication method (only works if the daemon allows it).
+func torAuthenticate(ctrl net.Conn, pass string) error {
+	if len(pass) != 0 {
+		fmt.Fprintf(ctrl, "AUTHENTICATE \"%s\"\r\n", pass)
+	} else {
+		fmt.Fprintf(ctrl, "AUTHENTICATE\r\n")
+	}
+	return torExpectOK(ctrl)
+}
+
+// torAddOnion asks Tor to create an ephemeral v3 onion service mapping
+// onionPort to localPort on 127.0.0.1, and returns the new service ID.
+func torAddOnion(ctrl net.Conn, onionPort, localPort int) (string, error) {
+	fmt.Fprintf(ctrl, "ADD_ONION NEW:ED25519-V3 Flags=DiscardPK Port=%d,127.0.0.1:%d\r\n",
+		onionPort, localPort)
+
+	r := bufio.NewReader(ctrl)
+	var serviceID string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		switch {
+		case strings.HasPrefix(line, "250-ServiceID="):
+			serviceID = strings.TrimPrefix(line, "250-ServiceID=")
+		case strings.HasPrefix(line, "250 OK"):
+			if len(serviceID) == 0 {
+				return "", fmt.Errorf("Tor did not return a ServiceID for ADD_ONION")
+			}
+			return serviceID, nil
+		case strings.HasPrefix(line, "5"):
+			return "", fmt.Errorf("Tor control error: %s", line)
+		}
+	}
+}
+
+func torExpectOK(ctrl net.Conn) error {
+	r := bufio.NewReader(ctrl)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if !strings.HasPrefix(line, "250") {
+		return fmt.Errorf("Tor control error: %s", line)
+	}
+	return nil
+}
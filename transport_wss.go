@@ -0,0 +1,167 @@
+// Copyright 2019 cruzbit developers
+// Use of this source code is governed by a MIT-style license that can be found in the LICENSE file.
+
+package cruzbit
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// peerDialer is websocket.DefaultDialer with certificate verification
+// disabled, since peers serve the self-signed cert generateSelfSignedCertAndKey
+// creates rather than one a public CA would vouch for.
+var peerDialer = &websocket.Dialer{
+	TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+}
+
+// WSSTransport is the original cruzbit transport: a secure WebSocket served
+// over a self-signed TLS certificate generated fresh on every run.
+type WSSTransport struct {
+	dataDir string
+	server  *http.Server
+	mux     *http.ServeMux
+	filter  PeerFilter
+
+	addrMu    sync.RWMutex
+	myAddress string
+}
+
+// SetFilter implements FilterableTransport.
+func (t *WSSTransport) SetFilter(filter PeerFilter) {
+	t.filter = filter
+}
+
+// NewWSSTransport returns a new WSSTransport. myAddress is advertised to
+// peers via the Cruzbit-Peer-Address header and may be empty if we're not
+// reachable for inbound connections.
+func NewWSSTransport(dataDir, myAddress string, port int) *WSSTransport {
+	mux := http.NewServeMux()
+	return &WSSTransport{
+		dataDir:   dataDir,
+		myAddress: myAddress,
+		mux:       mux,
+		server: &http.Server{
+			Addr:         "0.0.0.0:" + strconv.Itoa(port),
+			Handler:      mux,
+			ReadTimeout:  10 * time.Second,
+			WriteTimeout: 10 * time.Second,
+		},
+	}
+}
+
+// Scheme implements Transport.
+func (t *WSSTransport) Scheme() string {
+	return "wss"
+}
+
+// Advertise implements Transport.
+func (t *WSSTransport) Advertise() string {
+	t.addrMu.RLock()
+	defer t.addrMu.RUnlock()
+	return t.myAddress
+}
+
+// SetAdvertise implements Transport.
+func (t *WSSTransport) SetAdvertise(addr string) {
+	t.addrMu.Lock()
+	defer t.addrMu.Unlock()
+	t.myAddress = addr
+}
+
+// Listen implements Transport.
+func (t *WSSTransport) Listen(ctx context.Context, genesisID BlockID, handler func(PeerConn)) error {
+	certPath, keyPath, err := generateSelfSignedCertAndKey(t.dataDir)
+	if err != nil {
+		return err
+	}
+
+	t.mux.HandleFunc("/"+genesisID.String(), func(w http.ResponseWriter, r *http.Request) {
+		if t.filter != nil {
+			if err := t.filter(r.RemoteAddr, r.Header); err != nil {
+				log.Printf("Rejecting connection from %s: %s\n", r.RemoteAddr, err)
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+		}
+
+		theirAddress := r.Header.Get("Cruzbit-Peer-Address")
+		theirNonce := r.Header.Get("Cruzbit-Peer-Nonce")
+
+		conn, err := PeerUpgrader.Upgrade(w, r, nil)
+		if err != nil {
+			log.Println("Upgrade:", err)
+			return
+		}
+		handler(&basicPeerConn{Conn: wsConn{conn}, theirAddress: theirAddress, theirNonce: theirNonce, header: r.Header, scheme: t.Scheme()})
+	})
+
+	log.Println("Listening for new peer connections (wss)")
+	go func() {
+		if err := t.server.ListenAndServeTLS(certPath, keyPath); err != nil && err != http.ErrServerClosed {
+			log.Println(err)
+		}
+	}()
+	return nil
+}
+
+// Dial implements Transport.
+func (t *WSSTransport) Dial(ctx context.Context, addr, nonce, myAddr string) (PeerConn, error) {
+	header := http.Header{}
+	header.Set("Cruzbit-Peer-Nonce", nonce)
+	if len(myAddr) != 0 {
+		header.Set("Cruzbit-Peer-Address", myAddr)
+	}
+
+	url := fmt.Sprintf("wss://%s", addr)
+	conn, resp, err := peerDialer.DialContext(ctx, url, header)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	return &basicPeerConn{Conn: wsConn{conn}, theirAddress: "", scheme: t.Scheme()}, nil
+}
+
+// Shutdown implements Transport.
+func (t *WSSTransport) Shutdown() error {
+	return t.server.Shutdown(context.Background())
+}
+
+// wsConn adapts a *websocket.Conn to net.Conn so it satisfies PeerConn.
+type wsConn struct {
+	*websocket.Conn
+}
+
+func (c wsConn) Read(b []byte) (int, error) {
+	_, r, err := c.NextReader()
+	if err != nil {
+		return 0, err
+	}
+	return r.Read(b)
+}
+
+func (c wsConn) Write(b []byte) (int, error) {
+	if err := c.WriteMessage(websocket.BinaryMessage, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c wsConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+var _ net.Conn = wsConn{}